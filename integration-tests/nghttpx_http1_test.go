@@ -2,9 +2,11 @@ package nghttp2
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"github.com/bradfitz/http2/hpack"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"syscall"
 	"testing"
@@ -79,6 +81,708 @@ Content-Length: 0
 	}
 }
 
+// TestH1H1ExpectContinue tests that 100 response from backend is
+// forwarded to client, and request body is sent after that.
+func TestH1H1ExpectContinue(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		// Expect: 100-continue is not forwarded to backend, so we
+		// have to send 100 response by hand.
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("Error Hijack() = %v", err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			t.Fatalf("Error io.WriteString() = %v", err)
+		}
+		body := make([]byte, r.ContentLength)
+		if _, err := io.ReadFull(bufrw, body); err != nil {
+			t.Fatalf("Error io.ReadFull() = %v", err)
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %v\r\n\r\n%s", len(body), body)
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:   "TestH1H1ExpectContinue",
+		method: "POST",
+		header: []hpack.HeaderField{
+			pair("Expect", "100-continue"),
+		},
+		body: []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.interimStatus, 100; got != want {
+		t.Errorf("interimStatus: %v; want %v", got, want)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foo"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1ExpectContinueNoInterim tests that request body is sent
+// even if no 100 response arrives.
+func TestH1H1ExpectContinueNoInterim(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Expect"); got != "" {
+			t.Errorf("Expect: %v; want nothing", got)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Error reading r.body: %v", err)
+		}
+		w.Write(body)
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:   "TestH1H1ExpectContinueNoInterim",
+		method: "POST",
+		header: []hpack.HeaderField{
+			pair("Expect", "100-continue"),
+		},
+		body: []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.interimStatus, 0; got != want {
+		t.Errorf("interimStatus: %v; want %v", got, want)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foo"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1ResponseTrailer tests that trailer from HTTP/1 backend is
+// not forwarded, since server does not support response trailer yet.
+func TestH1H1ResponseTrailer(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("Error Hijack() = %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Trailer\r\n\r\n"+
+			"3\r\nfoo\r\n0\r\nX-Trailer: bar\r\n\r\n")
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1ResponseTrailer",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foo"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+	if got := res.trailer.Get("X-Trailer"); got != "" {
+		t.Errorf("X-Trailer: %v; want nothing", got)
+	}
+}
+
+// TestH1H1TLSNegotiated tests that server serves HTTP/1.1 to client
+// which negotiates http/1.1 in TLS handshake.
+func TestH1H1TLSNegotiated(t *testing.T) {
+	st := newServerTesterTLSConfig(nil, t, noopHandler, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+	})
+	defer st.Close()
+
+	if got, want := st.negotiatedProto, "http/1.1"; got != want {
+		t.Fatalf("st.negotiatedProto: %v; want %v", got, want)
+	}
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1TLSNegotiated",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1AddXff tests that server appends client address to
+// X-Forwarded-For header field sent by client.
+func TestH1H1AddXff(t *testing.T) {
+	st := newServerTester([]string{"--add-x-forwarded-for"}, t, noopHandler)
+	defer st.Close()
+
+	_, err := st.http1(requestParam{
+		name: "TestH1H1AddXff",
+		header: []hpack.HeaderField{
+			pair("X-Forwarded-For", "host"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	st.assertForwardedFor("host, 127.0.0.1")
+}
+
+// TestH1H1GenerateVia tests that server generates Via header field
+// to and from backend server.
+func TestH1H1GenerateVia(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1GenerateVia",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	st.assertVia(res, "1.1 nghttpx", "1.1 nghttpx")
+}
+
+// TestH1H1AppendVia tests that server adds value to existing Via
+// header field to and from backend server.
+func TestH1H1AppendVia(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Via", "bar")
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1AppendVia",
+		header: []hpack.HeaderField{
+			pair("via", "foo"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	st.assertVia(res, "foo, 1.1 nghttpx", "bar, 1.1 nghttpx")
+}
+
+// TestH1H1NoVia tests that server does not add value to existing Via
+// header field to and from backend server.
+func TestH1H1NoVia(t *testing.T) {
+	st := newServerTester([]string{"--no-via"}, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Via", "bar")
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1NoVia",
+		header: []hpack.HeaderField{
+			pair("via", "foo"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	st.assertVia(res, "foo", "bar")
+}
+
+// TestH1H1KeepAlive tests that multiple requests are served on the
+// same connection.
+func TestH1H1KeepAlive(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	defer st.Close()
+
+	for _, path := range []string{"/alpha", "/bravo"} {
+		res, err := st.http1(requestParam{
+			name: "TestH1H1KeepAlive" + path,
+			path: path,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http1() = %v", err)
+		}
+		st.assertResponse(res, 200, nil, []byte(path))
+		if res.connClose {
+			t.Errorf("%v: res.connClose = true; want false", path)
+		}
+	}
+}
+
+// TestH1H1ConnectionCloseUnusable tests that the connection is not
+// used after response with Connection: close.
+func TestH1H1ConnectionCloseUnusable(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1ConnectionCloseUnusable-1",
+		header: []hpack.HeaderField{
+			pair("Connection", "close"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.connClose, true; got != want {
+		t.Errorf("res.connClose: %v; want %v", got, want)
+	}
+
+	if _, err := st.http1(requestParam{
+		name: "TestH1H1ConnectionCloseUnusable-2",
+	}); err != errH1Closed {
+		t.Errorf("st.http1() = %v; want %v", err, errH1Closed)
+	}
+}
+
+// TestH1H1Pipelining tests that pipelined requests are served in
+// order, and an error response in the middle does not desync the
+// rest.
+func TestH1H1Pipelining(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notfound" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	defer st.Close()
+
+	paths := []string{"/alpha", "/notfound", "/bravo", "/charlie"}
+	var rps []requestParam
+	for _, path := range paths {
+		rps = append(rps, requestParam{
+			name: "TestH1H1Pipelining" + path,
+			path: path,
+		})
+	}
+
+	ress, err := st.http1Pipeline(rps)
+	if err != nil {
+		t.Fatalf("Error st.http1Pipeline() = %v", err)
+	}
+	if got, want := len(ress), len(paths); got != want {
+		t.Fatalf("len(ress) = %v; want %v", got, want)
+	}
+	for i, res := range ress {
+		if paths[i] == "/notfound" {
+			st.assertResponse(res, 404, nil, nil)
+			continue
+		}
+		st.assertResponse(res, 200, nil, []byte(paths[i]))
+	}
+}
+
+// TestH1H1AbsoluteFormRequestTarget tests that request target in
+// absolute-form is forwarded to backend.
+func TestH1H1AbsoluteFormRequestTarget(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:           "TestH1H1AbsoluteFormRequestTarget",
+		rawRequestLine: "GET http://example.org/alpha?bravo=charlie HTTP/1.1",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	br := st.backendRequest("TestH1H1AbsoluteFormRequestTarget")
+	if br == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if got, want := br.url.String(), "http://example.org/alpha?bravo=charlie"; got != want {
+		t.Errorf("request target: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1AsteriskFormRequestTarget tests that server accepts
+// server-wide OPTIONS request in asterisk-form.  net/http backend
+// server responds to OPTIONS * by itself without calling handler, so
+// the request target which backend receives is not checked.
+func TestH1H1AsteriskFormRequestTarget(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:           "TestH1H1AsteriskFormRequestTarget",
+		rawRequestLine: "OPTIONS * HTTP/1.1",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1MultipleBackends tests that server distributes backend
+// connections to multiple backend servers in round-robin.  Server
+// picks the next backend only when it creates new backend
+// connection, and keep-alive backend connection goes back to the
+// pool shared by all frontend connections of the worker, so backend
+// servers answer with Connection: close to make server connect to
+// backend for each request.
+func TestH1H1MultipleBackends(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+	}
+	st := newServerTesterBackends(nil, t, []http.HandlerFunc{handler, handler})
+	defer st.Close()
+
+	for i := 0; i < 4; i++ {
+		// server closes frontend connection too, because
+		// backend connection is closed.
+		if i > 0 {
+			if err := st.reconnect(); err != nil {
+				t.Fatalf("Error st.reconnect() = %v", err)
+			}
+		}
+		res, err := st.http1(requestParam{
+			name: fmt.Sprintf("TestH1H1MultipleBackends-%v", i),
+		})
+		if err != nil {
+			t.Fatalf("Error st.http1() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("status: %v; want %v", got, want)
+		}
+	}
+
+	if got, want := st.backendRequestCounts(), []int{2, 2}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("st.backendRequestCounts() = %v; want %v", got, want)
+	}
+}
+
+// TestH1H1LargeHeader tests that server responds with 400 if the
+// total size of request header fields exceeds 32KiB.  Unlike HTTP/2
+// frontend, HTTP/1 frontend treats it as parse error, instead of
+// responding with 431.
+func TestH1H1LargeHeader(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	// Keep the request just above the limit, so that server reads
+	// it entirely before closing the connection.  Otherwise unread
+	// data makes the connection reset, and the response may be lost.
+	res, err := st.http1(requestParam{
+		name: "TestH1H1LargeHeader",
+		header: []hpack.HeaderField{
+			pair("Cookie", headerValueOfSize(33*1024)),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 400; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH1H1Host tests that server forwards Host header field as is.
+func TestH1H1Host(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:      "TestH1H1Host",
+		authority: "host.example.org",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertBackendHost("host.example.org")
+}
+
+// TestH1H1PathAsIs tests that server forwards request target to
+// backend as is, without resolving dot segments or decoding
+// percent-encoded octets, and that query is preserved.  The request
+// line is sent raw, because net/http would rewrite the path.
+func TestH1H1PathAsIs(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	for i, path := range []string{
+		"/a/../b",
+		"/%2e%2e/",
+		"/a%2Fb",
+		"/a/./b?x=%2F&y=/../&z",
+	} {
+		res, err := st.http1(requestParam{
+			name:           fmt.Sprintf("TestH1H1PathAsIs-%v", i),
+			rawRequestLine: "GET " + path + " HTTP/1.1",
+		})
+		if err != nil {
+			t.Fatalf("Error st.http1() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", path, got, want)
+		}
+		st.assertBackendRequestURI(path)
+	}
+}
+
+// TestH1H1GETWithBody tests that server forwards request body of GET
+// request to backend unchanged.
+func TestH1H1GETWithBody(t *testing.T) {
+	st := newServerTester(nil, t, readBodyHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:   "TestH1H1GETWithBody",
+		method: "GET",
+		body:   []byte("hello world"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	req := st.backendRequest("TestH1H1GETWithBody")
+	if req == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if got, want := req.method, "GET"; got != want {
+		t.Errorf("backend request method: %v; want %v", got, want)
+	}
+	if got, want := string(req.body), "hello world"; got != want {
+		t.Errorf("backend request body: %q; want %q", got, want)
+	}
+}
+
+// TestH1H1HEAD tests that server sends no body for HEAD request,
+// while keeping Content-Length which GET would have, even if backend
+// sends body.  net/http backend server never sends body for HEAD
+// request, so rawHandler is used.  net/http does not read body of
+// HEAD response, so the following request on the same connection
+// detects body sent by mistake.
+func TestH1H1HEAD(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world"))
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:   "TestH1H1HEAD-1",
+		method: "HEAD",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := res.header.Get("Content-Length"), "11"; got != want {
+		t.Errorf("Content-Length: %v; want %v", got, want)
+	}
+	if got := len(res.body); got != 0 {
+		t.Errorf("len(body): %v; want 0", got)
+	}
+
+	res, err = st.http1(requestParam{
+		name: "TestH1H1HEAD-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "hello world"; got != want {
+		t.Errorf("body: %q; want %q", got, want)
+	}
+}
+
+// TestH1H1HTTP10 tests that server serves HTTP/1.0 request, and
+// closes the connection after the response, because HTTP/1.0 does not
+// keep connection alive by default.
+func TestH1H1HTTP10(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:      "TestH1H1HTTP10",
+		httpMajor: 1,
+		httpMinor: 0,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "hello"; got != want {
+		t.Errorf("body: %q; want %q", got, want)
+	}
+	if !res.connClose {
+		t.Errorf("res.connClose = false; want true")
+	}
+}
+
+// TestH1H1HTTP10NoHost tests that server accepts HTTP/1.0 request
+// without Host header field, which HTTP/1.0 does not require.  Server
+// forwards it to backend as HTTP/1.1 request without Host, because
+// HTTP/1 frontend has no authority to generate it from, and net/http
+// backend server rejects it with 400 before calling handler.  The
+// client receives that 400.
+func TestH1H1HTTP10NoHost(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("backend should not handle request without Host")
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:      "TestH1H1HTTP10NoHost",
+		httpMajor: 1,
+		httpMinor: 0,
+		noHost:    true,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 400; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if !res.connClose {
+		t.Errorf("res.connClose = false; want true")
+	}
+	if req := st.lastBackendRequest(); req != nil {
+		t.Errorf("backend handled request %v %v", req.method, req.requestURI)
+	}
+}
+
+// TestH1H1HTTP10KeepAlive tests that server keeps HTTP/1.0
+// connection alive if Connection: keep-alive is requested.
+func TestH1H1HTTP10KeepAlive(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer st.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := st.http1(requestParam{
+			name:      fmt.Sprintf("TestH1H1HTTP10KeepAlive-%v", i),
+			httpMajor: 1,
+			httpMinor: 0,
+			header: []hpack.HeaderField{
+				pair("Connection", "keep-alive"),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Error st.http1() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("status: %v; want %v", got, want)
+		}
+		if res.connClose {
+			t.Fatalf("res.connClose = true; want false")
+		}
+	}
+}
+
+// TestH1H1HopByHopHeaders tests that server strips hop-by-hop header
+// fields before forwarding request to backend.  Header fields
+// nominated by Connection are forwarded, because server in this tree
+// only strips the fixed set of hop-by-hop header fields, although RFC
+// 7230 requires them to be removed too.
+func TestH1H1HopByHopHeaders(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1HopByHopHeaders",
+		header: []hpack.HeaderField{
+			pair("Connection", "X-Custom"),
+			pair("Keep-Alive", "timeout=5"),
+			pair("Proxy-Connection", "keep-alive"),
+			pair("X-Custom", "foo"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertNoBackendHeader("Connection")
+	st.assertNoBackendHeader("Keep-Alive")
+	st.assertNoBackendHeader("Proxy-Connection")
+	st.assertBackendHeader("X-Custom", "foo")
+}
+
+// TestH1H1ContentLengthLongerBody tests that server forwards only as
+// many bytes of request body as Content-Length says.  In HTTP/1,
+// Content-Length delimits the message, so the excess is not an error
+// of this request; it is parsed as the next request.
+func TestH1H1ContentLengthLongerBody(t *testing.T) {
+	st := newServerTester(nil, t, readBodyHandler)
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:          "TestH1H1ContentLengthLongerBody",
+		method:        "POST",
+		contentLength: "5",
+		body:          []byte("hello world"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	req := st.backendRequest("TestH1H1ContentLengthLongerBody")
+	if req == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if got, want := string(req.body), "hello"; got != want {
+		t.Errorf("backend request body: %q; want %q", got, want)
+	}
+}
+
+// TestH1H1ContentEncodingPassthrough tests that server forwards
+// Accept-Encoding to backend, and response body compressed by backend
+// to client, without decompressing or recompressing it.
+func TestH1H1ContentEncodingPassthrough(t *testing.T) {
+	body := gzipBytes([]byte("hello world"))
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name: "TestH1H1ContentEncodingPassthrough",
+		header: []hpack.HeaderField{
+			pair("Accept-Encoding", "gzip, deflate"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	st.assertBackendHeader("Accept-Encoding", "gzip, deflate")
+	st.assertResponse(res, 200, map[string]string{"content-encoding": "gzip"}, body)
+
+	decoded, err := gunzipBytes(res.body)
+	if err != nil {
+		t.Fatalf("Error gunzipBytes() = %v", err)
+	}
+	if got, want := string(decoded), "hello world"; got != want {
+		t.Errorf("decoded body: %q; want %q", got, want)
+	}
+}
+
 // TestH1H1ConnectFailure tests that server handles the situation that
 // connection attempt to HTTP/1 backend failed.
 func TestH1H1ConnectFailure(t *testing.T) {
@@ -160,6 +864,35 @@ func TestH1H2ConnectFailure(t *testing.T) {
 	}
 }
 
+// TestH1H2ChunkedRequestBody tests that chunked request body is
+// forwarded to HTTP/2 backend.
+func TestH1H2ChunkedRequestBody(t *testing.T) {
+	st := newServerTester([]string{"--http2-bridge"}, t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Error reading r.body: %v", err)
+		}
+		if got, want := string(body), "hello world"; got != want {
+			t.Errorf("body: %v; want %v", got, want)
+		}
+	})
+	defer st.Close()
+
+	res, err := st.http1(requestParam{
+		name:      "TestH1H2ChunkedRequestBody",
+		method:    "POST",
+		body:      []byte("hello world"),
+		chunked:   true,
+		chunkSize: 3,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http1() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
 // TestH1H2NoHost tests that server rejects request without Host
 // header field for HTTP/2 backend.
 func TestH1H2NoHost(t *testing.T) {
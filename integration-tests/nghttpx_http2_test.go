@@ -2,14 +2,20 @@ package nghttp2
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/bradfitz/http2"
 	"github.com/bradfitz/http2/hpack"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 )
 
 // TestH2H1PlainGET tests whether simple HTTP/2 GET request works.
@@ -30,6 +36,2873 @@ func TestH2H1PlainGET(t *testing.T) {
 	}
 }
 
+// TestH2H1Ping tests that server replies to PING with PING ACK
+// carrying the same opaque data.
+func TestH2H1Ping(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if _, err := st.ping([8]byte{'n', 'g', 'h', 't', 't', 'p', 'x', '1'}); err != nil {
+		t.Fatalf("Error st.ping() = %v", err)
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1Ping",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1InitialWindowSize tests that server honors
+// SETTINGS_INITIAL_WINDOW_SIZE sent by client when the response body
+// fits in the window.
+func TestH2H1InitialWindowSize(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo"))
+	})
+	defer st.Close()
+
+	st.settings = []http2.Setting{
+		{ID: http2.SettingInitialWindowSize, Val: 3},
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1InitialWindowSize",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foo"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1SettingsIncreaseInitialWindowSize tests that increasing
+// SETTINGS_INITIAL_WINDOW_SIZE after the preface enlarges the window
+// of the open stream, and resumes the response stalled on it.
+func TestH2H1SettingsIncreaseInitialWindowSize(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	})
+	defer st.Close()
+
+	st.manualWindowUpdate = true
+	st.settings = []http2.Setting{
+		{ID: http2.SettingInitialWindowSize, Val: 10},
+	}
+
+	sh, err := st.http2Async(requestParam{
+		name: "TestH2H1SettingsIncreaseInitialWindowSize",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+
+	for len(sh.res.body) < 10 {
+		if _, _, err := sh.RecvData(); err != nil {
+			t.Fatalf("Error sh.RecvData() = %v", err)
+		}
+	}
+
+	if err := st.writeSettings(http2.Setting{
+		ID: http2.SettingInitialWindowSize, Val: 100,
+	}); err != nil {
+		t.Fatalf("Error st.writeSettings() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := len(res.body), 100; got != want {
+		t.Errorf("len(body): %v; want %v", got, want)
+	}
+}
+
+// TestH2H1SettingsDecreaseInitialWindowSize tests that decreasing
+// SETTINGS_INITIAL_WINDOW_SIZE after the preface can make the window
+// of the open stream negative, and that server sends no DATA until
+// WINDOW_UPDATE makes it positive again.
+func TestH2H1SettingsDecreaseInitialWindowSize(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	})
+	defer st.Close()
+
+	st.manualWindowUpdate = true
+	st.settings = []http2.Setting{
+		{ID: http2.SettingInitialWindowSize, Val: 50},
+	}
+
+	sh, err := st.http2Async(requestParam{
+		name: "TestH2H1SettingsDecreaseInitialWindowSize",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+
+	for len(sh.res.body) < 50 {
+		if _, _, err := sh.RecvData(); err != nil {
+			t.Fatalf("Error sh.RecvData() = %v", err)
+		}
+	}
+
+	// window of the stream becomes 0 - (50 - 20) = -30.
+	if err := st.writeSettings(http2.Setting{
+		ID: http2.SettingInitialWindowSize, Val: 20,
+	}); err != nil {
+		t.Fatalf("Error st.writeSettings() = %v", err)
+	}
+	// window of the stream becomes 0.
+	if err := st.writeWindowUpdate(sh.res.streamID, 30); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+	if err := st.expectNoFrame(500 * time.Millisecond); err != nil {
+		t.Fatalf("Error st.expectNoFrame() = %v", err)
+	}
+
+	if err := st.writeWindowUpdate(sh.res.streamID, 50); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := len(res.body), 100; got != want {
+		t.Errorf("len(body): %v; want %v", got, want)
+	}
+}
+
+// TestH2H1InvalidEnablePush tests that server treats invalid
+// SETTINGS_ENABLE_PUSH value as connection error.
+func TestH2H1InvalidEnablePush(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if err := st.writePreface([]http2.Setting{
+		{ID: http2.SettingEnablePush, Val: 2},
+	}); err != nil {
+		t.Fatalf("Error st.writePreface() = %v", err)
+	}
+
+	frames, err := st.readFrames(func(fr http2.Frame) bool {
+		_, ok := fr.(*http2.GoAwayFrame)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+	f := frames[len(frames)-1].(*http2.GoAwayFrame)
+	if got, want := f.ErrCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ServerSettings tests that server advertises SETTINGS
+// according to command-line options.
+func TestH2H1ServerSettings(t *testing.T) {
+	st := newServerTester([]string{"--http2-max-concurrent-streams=30", "--frontend-http2-window-bits=18"}, t, noopHandler)
+	defer st.Close()
+
+	if err := st.writePreface(nil); err != nil {
+		t.Fatalf("Error st.writePreface() = %v", err)
+	}
+
+	if got, ok := st.serverSetting(http2.SettingMaxConcurrentStreams); !ok || got != 30 {
+		t.Errorf("SETTINGS_MAX_CONCURRENT_STREAMS: %v, %v; want 30, true", got, ok)
+	}
+	if got, ok := st.serverSetting(http2.SettingInitialWindowSize); !ok || got != (1<<18)-1 {
+		t.Errorf("SETTINGS_INITIAL_WINDOW_SIZE: %v, %v; want %v, true", got, ok, (1<<18)-1)
+	}
+	// server uses the default header table size, and does not
+	// send it explicitly.
+	if got, ok := st.serverSetting(http2.SettingHeaderTableSize); ok {
+		t.Errorf("SETTINGS_HEADER_TABLE_SIZE: %v; want nothing", got)
+	}
+}
+
+// TestH2H1Upgrade tests HTTP/1.1 Upgrade to HTTP/2.
+func TestH2H1Upgrade(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upgraded"))
+	})
+	defer st.Close()
+
+	res, err := st.http2Upgrade(requestParam{
+		name: "TestH2H1Upgrade",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Upgrade() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "upgraded"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+
+	// subsequent request goes to stream 3
+	res, err = st.http2(requestParam{
+		name: "TestH2H1Upgrade-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.streamID, uint32(3); got != want {
+		t.Errorf("res.streamID: %v; want %v", got, want)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1LargeResponse tests that response body larger than the
+// initial flow control window is received.
+func TestH2H1LargeResponse(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100000))
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1LargeResponse",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := len(res.body), 100000; got != want {
+		t.Errorf("len(body): %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ManualWindowUpdate tests that server stops sending DATA
+// when flow control window is exhausted, and resumes after
+// WINDOW_UPDATE.
+func TestH2H1ManualWindowUpdate(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100000))
+	})
+	defer st.Close()
+
+	st.manualWindowUpdate = true
+
+	if _, err := st.writeHTTP2Request(requestParam{
+		name: "TestH2H1ManualWindowUpdate",
+	}, true); err != nil {
+		t.Fatalf("Error st.writeHTTP2Request() = %v", err)
+	}
+
+	// initial window size is 65535
+	received := 0
+	if _, err := st.readFrames(func(fr http2.Frame) bool {
+		f, ok := fr.(*http2.DataFrame)
+		if !ok || f.StreamID != 1 {
+			return false
+		}
+		received += len(f.Data())
+		return received >= 65535
+	}); err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+	if got, want := received, 65535; got != want {
+		t.Fatalf("received: %v; want %v", got, want)
+	}
+
+	if err := st.writeWindowUpdate(0, 100000); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+	if err := st.writeWindowUpdate(1, 100000); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+
+	res, err := st.readHTTP2Response(&serverResponse{streamID: 1})
+	if err != nil {
+		t.Fatalf("Error st.readHTTP2Response() = %v", err)
+	}
+	if got, want := received+len(res.body), 100000; got != want {
+		t.Errorf("total body length: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ConnectionWindowExhausted tests that server stops sending
+// DATA on all streams when connection-level flow control window is
+// exhausted, even if stream-level windows are still open.
+func TestH2H1ConnectionWindowExhausted(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 40000))
+	})
+	defer st.Close()
+
+	st.manualConnWindowUpdate = true
+
+	var handles []*streamHandle
+	for i := 0; i < 2; i++ {
+		sh, err := st.http2Async(requestParam{
+			name: fmt.Sprintf("TestH2H1ConnectionWindowExhausted-%v", i),
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2Async() = %v", err)
+		}
+		handles = append(handles, sh)
+	}
+
+	for st.connRecvWindow > 0 {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("Error st.readFrame() = %v", err)
+		}
+		if err := st.dispatchFrame(f, nil); err != nil {
+			t.Fatalf("Error st.dispatchFrame() = %v", err)
+		}
+	}
+	if got, want := st.connDataReceived, initialWindowSize; got != want {
+		t.Errorf("connDataReceived = %v; want %v", got, want)
+	}
+	if err := st.expectNoFrame(500 * time.Millisecond); err != nil {
+		t.Fatalf("Error st.expectNoFrame() = %v", err)
+	}
+
+	st.manualConnWindowUpdate = false
+	if err := st.writeWindowUpdate(0, initialWindowSize); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+
+	for _, sh := range handles {
+		res, err := sh.Response()
+		if err != nil {
+			t.Fatalf("Error sh.Response() = %v", err)
+		}
+		if got, want := len(res.body), 40000; got != want {
+			t.Errorf("len(body) of stream %v = %v; want %v", res.streamID, got, want)
+		}
+	}
+	if got, want := st.connDataReceived, 80000; got != want {
+		t.Errorf("connDataReceived = %v; want %v", got, want)
+	}
+}
+
+// TestH2H1Priority tests that request HEADERS with priority and
+// subsequent PRIORITY frame are accepted.
+func TestH2H1Priority(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1Priority-1",
+		priority: &http2.PriorityParam{
+			Weight: 255,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	// make closed stream 1 depend on idle stream 5
+	if err := st.writePriority(1, 5, 15, true); err != nil {
+		t.Fatalf("Error st.writePriority() = %v", err)
+	}
+
+	res, err = st.http2(requestParam{
+		name: "TestH2H1Priority-2",
+		priority: &http2.PriorityParam{
+			StreamDep: 1,
+			Weight:    31,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1PriorityWeight tests that server shares connection-level
+// flow control window between sibling streams roughly in proportion
+// to their weights.  Connection window is kept exhausted while both
+// response bodies are buffered in server, so that DATA of both
+// streams is ready when window is opened.
+func TestH2H1PriorityWeight(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 512*1024))
+	})
+	defer st.Close()
+
+	st.manualConnWindowUpdate = true
+
+	var handles []*streamHandle
+	// PriorityParam.Weight is weight - 1, so weights are 256 and
+	// 16.
+	for i, weight := range []uint8{255, 15} {
+		sh, err := st.http2Async(requestParam{
+			name: fmt.Sprintf("TestH2H1PriorityWeight-%v", i),
+			priority: &http2.PriorityParam{
+				Weight: weight,
+			},
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2Async() = %v", err)
+		}
+		handles = append(handles, sh)
+	}
+	heavy, light := handles[0], handles[1]
+
+	for st.connRecvWindow > 0 {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("Error st.readFrame() = %v", err)
+		}
+		if err := st.dispatchFrame(f, nil); err != nil {
+			t.Fatalf("Error st.dispatchFrame() = %v", err)
+		}
+	}
+	// let server read response body of both streams from backend
+	time.Sleep(500 * time.Millisecond)
+
+	heavyStart, lightStart := len(heavy.res.body), len(light.res.body)
+
+	st.manualConnWindowUpdate = false
+	if err := st.writeWindowUpdate(0, initialWindowSize); err != nil {
+		t.Fatalf("Error st.writeWindowUpdate() = %v", err)
+	}
+
+	for !heavy.closed {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("Error st.readFrame() = %v", err)
+		}
+		if err := st.dispatchFrame(f, nil); err != nil {
+			t.Fatalf("Error st.dispatchFrame() = %v", err)
+		}
+	}
+
+	heavyGot, lightGot := len(heavy.res.body)-heavyStart, len(light.res.body)-lightStart
+	if heavyGot < 2*lightGot {
+		t.Errorf("received after window update: weight 256: %v bytes, weight 16: %v bytes; want the former at least twice the latter", heavyGot, lightGot)
+	}
+}
+
+// TestH2H1PrioritySelfDependency tests that server treats request
+// HEADERS which depends on itself as connection error.
+func TestH2H1PrioritySelfDependency(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1PrioritySelfDependency",
+		priority: &http2.PriorityParam{
+			StreamDep: 1,
+			Weight:    15,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.connErr, true; got != want {
+		t.Errorf("res.connErr: %v; want %v", got, want)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+	if got, want := res.goAwayLastStreamID, uint32(0); got != want {
+		t.Errorf("res.goAwayLastStreamID: %v; want %v", got, want)
+	}
+	if got, want := string(res.goAwayDebugData), "request HEADERS: depend on itself"; got != want {
+		t.Errorf("res.goAwayDebugData: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1Continuation tests that server accepts request header
+// block split into HEADERS and CONTINUATION frames.
+func TestH2H1Continuation(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Foo"), "bar"; got != want {
+			t.Errorf("X-Foo: %v; want %v", got, want)
+		}
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1Continuation",
+		header: []hpack.HeaderField{
+			pair("x-foo", "bar"),
+		},
+		forceContinuation: true,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1LargeHeaderBlock tests that server accepts request header
+// block which does not fit in 1 frame.
+func TestH2H1LargeHeaderBlock(t *testing.T) {
+	// '~' is not shortened by Huffman coding.
+	value := strings.Repeat("~", 20000)
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Large"), value; got != want {
+			t.Errorf("len(X-Large): %v; want %v", len(got), len(want))
+		}
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1LargeHeaderBlock",
+		header: []hpack.HeaderField{
+			pair("x-large", value),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ResponseTrailer tests that trailer from HTTP/1 backend is
+// not forwarded, since server does not support response trailer yet.
+func TestH2H1ResponseTrailer(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("Error Hijack() = %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Trailer\r\n\r\n"+
+			"3\r\nfoo\r\n0\r\nX-Trailer: bar\r\n\r\n")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ResponseTrailer",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foo"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+	if res.trailer != nil {
+		t.Errorf("trailer: %v; want nothing", res.trailer)
+	}
+}
+
+// TestH2H1Concurrent tests that server handles concurrent streams
+// without mixing up their responses.
+func TestH2H1Concurrent(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	defer st.Close()
+
+	var rps []requestParam
+	for i := 0; i < 5; i++ {
+		rps = append(rps, requestParam{
+			name: fmt.Sprintf("TestH2H1Concurrent-%v", i),
+			path: fmt.Sprintf("/%v", i),
+		})
+	}
+
+	ress, err := st.http2Concurrent(rps)
+	if err != nil {
+		t.Fatalf("Error st.http2Concurrent() = %v", err)
+	}
+	for i, res := range ress {
+		if got, want := res.status, 200; got != want {
+			t.Errorf("ress[%v].status: %v; want %v", i, got, want)
+		}
+		if got, want := string(res.body), rps[i].path; got != want {
+			t.Errorf("ress[%v].body: %v; want %v", i, got, want)
+		}
+	}
+}
+
+// TestH2H1MaxConcurrentStreams tests that server treats a stream
+// exceeding SETTINGS_MAX_CONCURRENT_STREAMS as connection error.
+func TestH2H1MaxConcurrentStreams(t *testing.T) {
+	st := newServerTester([]string{"--http2-max-concurrent-streams=1"}, t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	defer st.Close()
+
+	ress, err := st.http2Concurrent([]requestParam{
+		{name: "TestH2H1MaxConcurrentStreams-1"},
+		{name: "TestH2H1MaxConcurrentStreams-2"},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Concurrent() = %v", err)
+	}
+	if got, want := ress[1].connErr, true; got != want {
+		t.Errorf("ress[1].connErr: %v; want %v", got, want)
+	}
+	if got, want := ress[1].errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("ress[1].errCode: %v; want %v", got, want)
+	}
+	if got, want := ress[1].goAwayLastStreamID, uint32(1); got != want {
+		t.Errorf("ress[1].goAwayLastStreamID: %v; want %v", got, want)
+	}
+	if got, want := string(ress[1].goAwayDebugData), "request HEADERS: max concurrent streams exceeded"; got != want {
+		t.Errorf("ress[1].goAwayDebugData: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1DataOnStream0 tests that server treats DATA frame on
+// stream 0 as connection error.
+func TestH2H1DataOnStream0(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if err := st.writePreface(nil); err != nil {
+		t.Fatalf("Error st.writePreface() = %v", err)
+	}
+
+	// DATA frame with 3 bytes payload on stream 0
+	if err := st.writeRaw([]byte{0, 0, 3, 0, 0, 0, 0, 0, 0, 'f', 'o', 'o'}); err != nil {
+		t.Fatalf("Error st.writeRaw() = %v", err)
+	}
+
+	frames, err := st.readFrames(func(fr http2.Frame) bool {
+		_, ok := fr.(*http2.GoAwayFrame)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+	f := frames[len(frames)-1].(*http2.GoAwayFrame)
+	if got, want := f.ErrCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1BadPingLength tests that server treats PING frame whose
+// length is not 8 as connection error.
+func TestH2H1BadPingLength(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if err := st.writePreface(nil); err != nil {
+		t.Fatalf("Error st.writePreface() = %v", err)
+	}
+
+	// PING frame with 7 bytes payload
+	if err := st.writeRaw([]byte{0, 0, 7, 6, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7}); err != nil {
+		t.Fatalf("Error st.writeRaw() = %v", err)
+	}
+
+	frames, err := st.readFrames(func(fr http2.Frame) bool {
+		_, ok := fr.(*http2.GoAwayFrame)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+	f := frames[len(frames)-1].(*http2.GoAwayFrame)
+	if got, want := f.ErrCode, http2.ErrCodeFrameSize; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1EncoderTableSize tests that server decodes requests after
+// client changes its HPACK dynamic table size.
+func TestH2H1EncoderTableSize(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Foo"), "bar"; got != want {
+			t.Errorf("X-Foo: %v; want %v", got, want)
+		}
+	})
+	defer st.Close()
+
+	for i, n := range []uint32{4096, 0, 0, 256, 4096} {
+		if i > 0 {
+			if err := st.setEncoderTableSize(n); err != nil {
+				t.Fatalf("Error st.setEncoderTableSize(%v) = %v", n, err)
+			}
+		}
+
+		res, err := st.http2(requestParam{
+			name: fmt.Sprintf("TestH2H1EncoderTableSize-%v", i),
+			header: []hpack.HeaderField{
+				pair("x-foo", "bar"),
+			},
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("status(table size=%v): %v; want %v", n, got, want)
+		}
+	}
+
+	if err := st.setEncoderTableSize(4097); err == nil {
+		t.Errorf("st.setEncoderTableSize(4097) succeeded; want error")
+	}
+}
+
+// TestH2H1EncoderTableSizeExceeded tests that server sends GOAWAY
+// with COMPRESSION_ERROR if client's dynamic table size update
+// exceeds SETTINGS_HEADER_TABLE_SIZE.
+func TestH2H1EncoderTableSizeExceeded(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	st.ignoreServerTableSize = true
+	if err := st.setEncoderTableSize(defaultHeaderTableSize * 2); err != nil {
+		t.Fatalf("Error st.setEncoderTableSize() = %v", err)
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1EncoderTableSizeExceeded",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.errCode, http2.ErrCodeCompression; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+	if got, want := res.connErr, true; got != want {
+		t.Errorf("res.connErr: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1MalformedHeaderBlock tests that server sends GOAWAY with
+// COMPRESSION_ERROR if header block cannot be decoded.
+func TestH2H1MalformedHeaderBlock(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	for i, tc := range []struct {
+		desc  string
+		block []byte
+	}{
+		// indexed header field whose index is beyond static
+		// table, while dynamic table is empty
+		{desc: "invalid index", block: []byte{0x80 | 62}},
+		// literal header field without indexing with name
+		// :path, and 1 byte Huffman encoded value, whose
+		// padding after '0' (00000) is not EOS prefix
+		{desc: "invalid Huffman padding", block: []byte{0x04, 0x81, 0x00}},
+	} {
+		if i > 0 {
+			if err := st.reconnect(); err != nil {
+				t.Fatalf("Error st.reconnect() = %v", err)
+			}
+		}
+		if err := st.writeHeadersRaw(1, tc.block, true, true); err != nil {
+			t.Fatalf("Error st.writeHeadersRaw() = %v", err)
+		}
+
+		frames, err := st.readFrames(func(f http2.Frame) bool {
+			_, ok := f.(*http2.GoAwayFrame)
+			return ok
+		})
+		if err != nil {
+			t.Fatalf("%v: Error st.readFrames() = %v", tc.desc, err)
+		}
+		f := frames[len(frames)-1].(*http2.GoAwayFrame)
+		if got, want := f.ErrCode, http2.ErrCodeCompression; got != want {
+			t.Errorf("%v: f.ErrCode: %v; want %v", tc.desc, got, want)
+		}
+	}
+}
+
+// TestH2H1NeverIndexedHeader tests that server accepts header field
+// in never indexed representation, and that its HPACK context stays
+// in sync with st.enc, because such field is not added to the dynamic
+// table.
+func TestH2H1NeverIndexedHeader(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	// :method GET, :scheme http and :path / are in static table.
+	block := []byte{0x82, 0x86, 0x84}
+	// :authority is index 1 of static table.
+	block = append(block, 0x01, byte(len(st.authority)))
+	block = append(block, st.authority...)
+	block = append(block, hpackLiteral(0x00, "test-case", "TestH2H1NeverIndexedHeader-1")...)
+	block = append(block, hpackLiteral(0x10, "x-secret", "foo")...)
+
+	id := st.nextStreamID
+	st.nextStreamID += 2
+	if err := st.writeHeadersRaw(id, block, true, true); err != nil {
+		t.Fatalf("Error st.writeHeadersRaw() = %v", err)
+	}
+	res, err := st.readHTTP2Response(&serverResponse{streamID: id})
+	if err != nil {
+		t.Fatalf("Error st.readHTTP2Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertBackendHeader("X-Secret", "foo")
+
+	res, err = st.http2(requestParam{
+		name: "TestH2H1NeverIndexedHeader-2",
+		header: []hpack.HeaderField{
+			pair("x-foo", "bar"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertBackendHeader("X-Foo", "bar")
+}
+
+// TestH2H1StreamReadTimeout tests that server resets the stream if
+// client stops sending request body longer than
+// --stream-read-timeout.  The error code is NO_ERROR.
+func TestH2H1StreamReadTimeout(t *testing.T) {
+	st := newServerTester([]string{"--stream-read-timeout=1s"}, t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	})
+	defer st.Close()
+
+	sh, err := st.http2Begin(requestParam{
+		name:   "TestH2H1StreamReadTimeout",
+		method: "POST",
+		body:   []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.status, 0; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if !res.reset {
+		t.Errorf("res.reset = false; want true")
+	}
+	if got, want := res.errCode, http2.ErrCodeNo; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1IncrementalRequestBody tests that request body sent in
+// several DATA frames is forwarded to backend.
+func TestH2H1IncrementalRequestBody(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Error reading r.Body: %v", err)
+		}
+		if got, want := string(body), "foobarbaz"; got != want {
+			t.Errorf("body: %v; want %v", got, want)
+		}
+	})
+	defer st.Close()
+
+	sh, err := st.http2Begin(requestParam{
+		name:   "TestH2H1IncrementalRequestBody",
+		method: "POST",
+		body:   []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+
+	if err := sh.SendData([]byte("bar"), false); err != nil {
+		t.Fatalf("Error sh.SendData() = %v", err)
+	}
+	if err := sh.SendData([]byte("baz"), true); err != nil {
+		t.Fatalf("Error sh.SendData() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1StreamHandle tests that frames are demultiplexed to the
+// streams opened by http2Begin.
+func TestH2H1StreamHandle(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Error reading r.Body: %v", err)
+		}
+		w.Write(body)
+	})
+	defer st.Close()
+
+	sh1, err := st.http2Begin(requestParam{
+		name:   "TestH2H1StreamHandle-1",
+		method: "POST",
+		body:   []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+	sh2, err := st.http2Begin(requestParam{
+		name:   "TestH2H1StreamHandle-2",
+		method: "POST",
+		body:   []byte("bar"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+
+	if err := sh2.SendData([]byte("baz"), true); err != nil {
+		t.Fatalf("Error sh2.SendData() = %v", err)
+	}
+	res2, err := sh2.Response()
+	if err != nil {
+		t.Fatalf("Error sh2.Response() = %v", err)
+	}
+	if got, want := res2.status, 200; got != want {
+		t.Errorf("res2.status: %v; want %v", got, want)
+	}
+	if got, want := string(res2.body), "barbaz"; got != want {
+		t.Errorf("res2.body: %v; want %v", got, want)
+	}
+
+	if err := sh1.SendHeaders([]hpack.HeaderField{pair("x-trailer", "qux")}, true); err != nil {
+		t.Fatalf("Error sh1.SendHeaders() = %v", err)
+	}
+	f, err := sh1.Recv()
+	if err != nil {
+		t.Fatalf("Error sh1.Recv() = %v", err)
+	}
+	if _, ok := f.(*http2.HeadersFrame); !ok {
+		t.Errorf("f.Header().Type: %v; want %v", f.Header().Type, http2.FrameHeaders)
+	}
+	res1, err := sh1.Response()
+	if err != nil {
+		t.Fatalf("Error sh1.Response() = %v", err)
+	}
+	if got, want := res1.status, 200; got != want {
+		t.Errorf("res1.status: %v; want %v", got, want)
+	}
+	if got, want := string(res1.body), "foo"; got != want {
+		t.Errorf("res1.body: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1StreamHandleRST tests that server keeps connection after
+// client resets the stream opened by http2Begin.
+func TestH2H1StreamHandleRST(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	sh, err := st.http2Begin(requestParam{
+		name:   "TestH2H1StreamHandleRST-1",
+		method: "POST",
+		body:   []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+	if err := sh.SendRST(http2.ErrCodeCancel); err != nil {
+		t.Fatalf("Error sh.SendRST() = %v", err)
+	}
+	if _, err := sh.Recv(); err != io.EOF {
+		t.Errorf("sh.Recv() = %v; want %v", err, io.EOF)
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1StreamHandleRST-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ResponseStreaming tests that server forwards response
+// body to client without waiting for backend to finish the response.
+func TestH2H1ResponseStreaming(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo"))
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Second)
+		w.Write([]byte("bar"))
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ResponseStreaming",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "foobar"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+	// firstByteTime is not used, because server sends HEADERS
+	// before the body arrives even if it buffers the body.
+	if got, min := res.lastByteTime.Sub(res.firstDataTime), 500*time.Millisecond; got < min {
+		t.Errorf("lastByteTime - firstDataTime: %v; want >= %v", got, min)
+	}
+}
+
+// TestH2H1NoFrameAfterResponse tests that server sends no frame
+// after the response is completed.
+func TestH2H1NoFrameAfterResponse(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1NoFrameAfterResponse",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	if err := st.expectNoFrame(500 * time.Millisecond); err != nil {
+		t.Errorf("st.expectNoFrame() = %v", err)
+	}
+}
+
+// TestH2H1Connect tests that server tunnels data through CONNECT
+// stream.
+func TestH2H1Connect(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Method, "CONNECT"; got != want {
+			t.Errorf("r.Method: %v; want %v", got, want)
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("Error hijacking connection: %v", err)
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bufrw.Flush()
+		// echo back the tunneled data
+		io.Copy(conn, bufrw)
+	})
+	defer st.Close()
+
+	sh, err := st.connect(requestParam{
+		name: "TestH2H1Connect",
+	})
+	if err != nil {
+		t.Fatalf("Error st.connect() = %v", err)
+	}
+
+	if err := sh.SendData([]byte("hello"), false); err != nil {
+		t.Fatalf("Error sh.SendData() = %v", err)
+	}
+	for len(sh.res.body) < len("hello") {
+		if _, err := sh.Recv(); err != nil {
+			t.Fatalf("Error sh.Recv() = %v", err)
+		}
+	}
+	if got, want := sh.res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(sh.res.body), "hello"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ExtendedConnect tests that server rejects CONNECT request
+// with :scheme and :path, which is used by extended CONNECT.
+func TestH2H1ExtendedConnect(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward extended CONNECT")
+	})
+	defer st.Close()
+
+	sh, err := st.connect(requestParam{
+		name:     "TestH2H1ExtendedConnect",
+		protocol: "websocket",
+	})
+	if err != nil {
+		t.Fatalf("Error st.connect() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ResponseHeaderFieldOrder tests that :status comes first in
+// response header, and that the relative order of duplicated header
+// fields is preserved.
+func TestH2H1ResponseHeaderFieldOrder(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("set-cookie", "a=1")
+		w.Header().Add("set-cookie", "b=2")
+		w.Header().Add("set-cookie", "c=3")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ResponseHeaderFieldOrder",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if len(res.headerFields) == 0 {
+		t.Fatalf("len(res.headerFields) = 0; want > 0")
+	}
+	if got, want := res.headerFields[0], pair(":status", "200"); got != want {
+		t.Errorf("res.headerFields[0]: %v; want %v", got, want)
+	}
+	var cookies []string
+	for _, f := range res.headerFields {
+		if f.Name == "set-cookie" {
+			cookies = append(cookies, f.Value)
+		}
+	}
+	if got, want := strings.Join(cookies, ", "), "a=1, b=2, c=3"; got != want {
+		t.Errorf("set-cookie: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1StrictResponseHeader tests that server emits well-formed
+// pseudo header fields in response header.
+func TestH2H1StrictResponseHeader(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-foo", "bar")
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+	})
+	defer st.Close()
+
+	st.strictHeader = true
+	res, err := st.http2(requestParam{
+		name: "TestH2H1StrictResponseHeader",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 404; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if res.headerError != nil {
+		t.Errorf("res.headerError = %v", res.headerError)
+	}
+}
+
+// TestH2H1PaddedRequestBody tests that server strips padding of
+// DATA before forwarding request body to backend.
+func TestH2H1PaddedRequestBody(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Error reading r.Body: %v", err)
+		}
+		w.Header().Set("request-body", string(body))
+	})
+	defer st.Close()
+
+	tests := []struct {
+		body   string
+		padLen int
+	}{
+		{body: "foo", padLen: 10},
+		{body: "foo", padLen: 255},
+		// zero-length data plus padding
+		{body: "", padLen: 10},
+	}
+
+	for i, tt := range tests {
+		res, err := st.http2(requestParam{
+			name:   fmt.Sprintf("TestH2H1PaddedRequestBody-%v", i),
+			method: "POST",
+			body:   []byte(tt.body),
+			padLen: tt.padLen,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("#%v: status: %v; want %v", i, got, want)
+		}
+		if got, want := res.header.Get("request-body"), tt.body; got != want {
+			t.Errorf("#%v: request-body: %v; want %v", i, got, want)
+		}
+	}
+}
+
+// TestH2H1PaddedRequestBodyFlowControl tests that server counts
+// padding in connection-level flow control, and gives it back to
+// client by WINDOW_UPDATE.  The total length of DATA exceeds the
+// initial connection window size.
+func TestH2H1PaddedRequestBodyFlowControl(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	})
+	defer st.Close()
+
+	for i := 0; i < 5; i++ {
+		res, err := st.http2(requestParam{
+			name:   fmt.Sprintf("TestH2H1PaddedRequestBodyFlowControl-%v", i),
+			method: "POST",
+			body:   make([]byte, 16000),
+			padLen: 255,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("#%v: status: %v; want %v", i, got, want)
+		}
+		if res.connErr {
+			t.Fatalf("#%v: res.errCode = %v; want no connection error", i, res.errCode)
+		}
+	}
+}
+
+// TestH2H1PaddedHeaders tests that server strips padding of HEADERS.
+func TestH2H1PaddedHeaders(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Foo"), "bar"; got != want {
+			t.Errorf("X-Foo: %v; want %v", got, want)
+		}
+	})
+	defer st.Close()
+
+	for i, padLen := range []uint8{1, 255} {
+		res, err := st.http2(requestParam{
+			name: fmt.Sprintf("TestH2H1PaddedHeaders-%v", i),
+			header: []hpack.HeaderField{
+				pair("x-foo", "bar"),
+			},
+			headerPadLen: padLen,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("#%v: status: %v; want %v", i, got, want)
+		}
+	}
+}
+
+// TestH2H1PaddedHeadersFullFrame tests that server accepts padded
+// HEADERS whose header block fragment and padding fill the frame
+// payload up to SETTINGS_MAX_FRAME_SIZE.
+func TestH2H1PaddedHeadersFullFrame(t *testing.T) {
+	// '~' is not shortened by Huffman coding.
+	value := strings.Repeat("~", 20000)
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Large"), value; got != want {
+			t.Errorf("len(X-Large): %v; want %v", len(got), len(want))
+		}
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1PaddedHeadersFullFrame",
+		header: []hpack.HeaderField{
+			pair("x-large", value),
+		},
+		headerPadLen: 255,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if res.connErr {
+		t.Errorf("res.errCode = %v; want no connection error", res.errCode)
+	}
+}
+
+// TestH2H1EchoRequest tests that server preserves method, path and
+// body of the request.
+func TestH2H1EchoRequest(t *testing.T) {
+	st := newServerTester(nil, t, echoHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1EchoRequest",
+		method: "PUT",
+		path:   "/alpha/bravo?charlie=delta",
+		body:   []byte("foo"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	var req echoRequest
+	if err := json.Unmarshal(res.body, &req); err != nil {
+		t.Fatalf("Error json.Unmarshal() = %v", err)
+	}
+	want := echoRequest{
+		Method: "PUT",
+		Path:   "/alpha/bravo?charlie=delta",
+		Body:   "foo",
+	}
+	if req != want {
+		t.Errorf("request: %+v; want %+v", req, want)
+	}
+}
+
+// TestH2H1FixedResponse tests that server forwards status, header
+// and body of the response.
+func TestH2H1FixedResponse(t *testing.T) {
+	st := newServerTester(nil, t, fixedHandler(201, http.Header{"X-Foo": {"bar"}}, []byte("created")))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1FixedResponse",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertResponse(res, 201, map[string]string{"x-foo": "bar"}, []byte("created"))
+}
+
+// TestH2H1BackendRequest tests that backend receives the request
+// forwarded by server.
+func TestH2H1BackendRequest(t *testing.T) {
+	st := newServerTester(nil, t, readBodyHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1BackendRequest",
+		method: "POST",
+		path:   "/alpha?bravo",
+		header: []hpack.HeaderField{
+			pair("x-foo", "bar"),
+		},
+		body: []byte("charlie"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	req := st.backendRequest("TestH2H1BackendRequest")
+	if req == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if req != st.lastBackendRequest() {
+		t.Errorf("st.lastBackendRequest() is not the request")
+	}
+	if got, want := req.method, "POST"; got != want {
+		t.Errorf("method: %v; want %v", got, want)
+	}
+	if got, want := req.url.RequestURI(), "/alpha?bravo"; got != want {
+		t.Errorf("url: %v; want %v", got, want)
+	}
+	if got, want := req.header.Get("X-Foo"), "bar"; got != want {
+		t.Errorf("X-Foo: %v; want %v", got, want)
+	}
+	if got, want := string(req.body), "charlie"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1NoXff tests that server does not generate X-Forwarded-For
+// header field by default.
+func TestH2H1NoXff(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	_, err := st.http2(requestParam{
+		name: "TestH2H1NoXff",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertForwardedFor("")
+}
+
+// TestH2H1DuplicateHeaderFields tests that server forwards
+// duplicated header fields to backend in the same order, and
+// concatenates cookies with "; ".
+func TestH2H1DuplicateHeaderFields(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	_, err := st.http2(requestParam{
+		name: "TestH2H1DuplicateHeaderFields",
+		header: []hpack.HeaderField{
+			pair("x-foo", "alpha"),
+			pair("cookie", "a=b"),
+			pair("x-foo", "bravo"),
+			pair("cookie", "c=d"),
+			pair("x-foo", "charlie"),
+			pair("cookie", "e=f"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+
+	req := st.backendRequest("TestH2H1DuplicateHeaderFields")
+	if req == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if got, want := strings.Join(req.headerValues("x-foo"), "|"), "alpha|bravo|charlie"; got != want {
+		t.Errorf("x-foo: %v; want %v", got, want)
+	}
+	if got, want := strings.Join(req.headerValues("cookie"), "|"), "a=b; c=d; e=f"; got != want {
+		t.Errorf("cookie: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1DisablePush tests that server sends no PUSH_PROMISE to
+// client which sends SETTINGS_ENABLE_PUSH=0.
+func TestH2H1DisablePush(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "</style.css>; rel=preload")
+	})
+	defer st.Close()
+
+	st.disablePush = true
+	res, err := st.http2(requestParam{
+		name: "TestH2H1DisablePush",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := len(res.pushResponses), 0; got != want {
+		t.Errorf("len(res.pushResponses): %v; want %v", got, want)
+	}
+	if err := st.expectNoFrame(500 * time.Millisecond); err != nil {
+		t.Errorf("st.expectNoFrame() = %v", err)
+	}
+}
+
+// TestH2H1ResponseByStreamID tests that the response of a stream can
+// be read while the other streams are in flight.
+func TestH2H1ResponseByStreamID(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(time.Second)
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+	defer st.Close()
+
+	paths := []string{"/slow", "/fast1", "/fast2"}
+	var shs []*streamHandle
+	for _, path := range paths {
+		sh, err := st.http2Async(requestParam{
+			name: "TestH2H1ResponseByStreamID" + path,
+			path: path,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2Async() = %v", err)
+		}
+		shs = append(shs, sh)
+	}
+
+	// The responses of /fast1 and /fast2 arrive first, and they
+	// are buffered while waiting for /slow.
+	for _, i := range []int{0, 2, 1} {
+		res, err := shs[i].Response()
+		if err != nil {
+			t.Fatalf("Error sh.Response() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", res.streamID, got, want)
+		}
+		if got, want := string(res.body), paths[i]; got != want {
+			t.Errorf("%v: body: %v; want %v", res.streamID, got, want)
+		}
+	}
+}
+
+// TestH2H1GRPC tests that a length-prefixed gRPC message is proxied
+// to the backend and back, together with grpc-status.
+func TestH2H1GRPC(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Content-Type"), "application/grpc"; got != want {
+			t.Errorf("Content-Type: %v; want %v", got, want)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error reading request body: %v", err)
+			return
+		}
+		msgs, err := parseGRPCFrames(body)
+		if err != nil {
+			t.Errorf("Error parseGRPCFrames() = %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		// HTTP/1 backend cannot send trailer; send grpc-status in
+		// header instead.
+		w.Header().Set("Grpc-Status", "0")
+		for _, msg := range msgs {
+			w.Write(grpcFrame(msg))
+		}
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1GRPC",
+		method: "POST",
+		header: []hpack.HeaderField{
+			pair("content-type", "application/grpc"),
+			pair("te", "trailers"),
+		},
+		body: grpcFrame([]byte("hello")),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if res.headersEndStream {
+		t.Errorf("res.headersEndStream = true; want false")
+	}
+	msgs, err := parseGRPCFrames(res.body)
+	if err != nil {
+		t.Fatalf("Error parseGRPCFrames() = %v", err)
+	}
+	if got, want := len(msgs), 1; got != want {
+		t.Fatalf("len(msgs) = %v; want %v", got, want)
+	}
+	if got, want := string(msgs[0]), "hello"; got != want {
+		t.Errorf("msgs[0] = %q; want %q", got, want)
+	}
+	if code, _, ok := res.grpcStatus(); !ok || code != 0 {
+		t.Errorf("res.grpcStatus() = %v, %v; want 0, true", code, ok)
+	}
+}
+
+// TestH2H1GRPCTrailersOnly tests that response without body is sent
+// in a single HEADERS frame with END_STREAM, and grpc-status and
+// grpc-message are taken from it.  nghttpx omits DATA only if the
+// response must not have body, so 204 is used here.
+func TestH2H1GRPCTrailersOnly(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "13")
+		w.Header().Set("Grpc-Message", "internal error")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1GRPCTrailersOnly",
+		method: "POST",
+		header: []hpack.HeaderField{
+			pair("content-type", "application/grpc"),
+			pair("te", "trailers"),
+		},
+		body: grpcFrame([]byte("hello")),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if !res.headersEndStream {
+		t.Errorf("res.headersEndStream = false; want true")
+	}
+	code, msg, ok := res.grpcStatus()
+	if !ok {
+		t.Fatalf("res.grpcStatus(): grpc-status is missing")
+	}
+	if got, want := code, 13; got != want {
+		t.Errorf("grpc-status: %v; want %v", got, want)
+	}
+	if got, want := msg, "internal error"; got != want {
+		t.Errorf("grpc-message: %q; want %q", got, want)
+	}
+}
+
+// TestH2H1InvalidPseudoHeaders tests that server resets the stream
+// with PROTOCOL_ERROR if request has malformed pseudo header fields.
+func TestH2H1InvalidPseudoHeaders(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	tests := []struct {
+		desc    string
+		headers []hpack.HeaderField
+	}{
+		{
+			desc: "duplicate :path",
+			headers: []hpack.HeaderField{
+				pair(":method", "GET"),
+				pair(":scheme", "http"),
+				pair(":authority", st.authority),
+				pair(":path", "/"),
+				pair(":path", "/alpha"),
+			},
+		},
+		{
+			desc: "missing :method",
+			headers: []hpack.HeaderField{
+				pair(":scheme", "http"),
+				pair(":authority", st.authority),
+				pair(":path", "/"),
+			},
+		},
+		{
+			desc: "unknown :foo",
+			headers: []hpack.HeaderField{
+				pair(":method", "GET"),
+				pair(":scheme", "http"),
+				pair(":authority", st.authority),
+				pair(":path", "/"),
+				pair(":foo", "bar"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := st.http2(requestParam{
+			name:             "TestH2H1InvalidPseudoHeaders " + tt.desc,
+			rawPseudoHeaders: tt.headers,
+		})
+		if err != nil {
+			t.Fatalf("%v: Error st.http2() = %v", tt.desc, err)
+		}
+		if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+			t.Errorf("%v: res.errCode = %v; want %v", tt.desc, got, want)
+		}
+	}
+}
+
+// TestH2H1UppercaseHeaderName tests that server resets the stream
+// with PROTOCOL_ERROR if request has header field name which
+// contains uppercase letters.
+func TestH2H1UppercaseHeaderName(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1UppercaseHeaderName",
+		header: []hpack.HeaderField{
+			pair("Content-Type", "text/plain"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode = %v; want %v", got, want)
+	}
+}
+
+// TestH2H1UppercasePseudoHeaderName tests that server resets the
+// stream with PROTOCOL_ERROR if request has pseudo header field name
+// which contains uppercase letters.
+func TestH2H1UppercasePseudoHeaderName(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1UppercasePseudoHeaderName",
+		rawPseudoHeaders: []hpack.HeaderField{
+			pair(":method", "GET"),
+			pair(":scheme", "http"),
+			pair(":authority", st.authority),
+			pair(":PATH", "/"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode = %v; want %v", got, want)
+	}
+}
+
+// TestH2H1BackendProto tests that server forwards request to backend
+// in HTTP/1.1.
+func TestH2H1BackendProto(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if _, err := st.http2(requestParam{
+		name: "TestH2H1BackendProto",
+	}); err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertBackendProto("HTTP/1.1")
+}
+
+// TestH2H1TE tests that server accepts TE header field only if its
+// value is "trailers", which is compared case-insensitively, and
+// resets the stream with PROTOCOL_ERROR otherwise.  Request without
+// TE is accepted.
+func TestH2H1TE(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	for i, tc := range []struct {
+		header []hpack.HeaderField
+		ok     bool
+	}{
+		{ok: true},
+		{header: []hpack.HeaderField{pair("te", "trailers")}, ok: true},
+		{header: []hpack.HeaderField{pair("te", "TRAILERS")}, ok: true},
+		{header: []hpack.HeaderField{pair("te", "gzip")}},
+		{header: []hpack.HeaderField{pair("te", "trailers, gzip")}},
+		{header: []hpack.HeaderField{pair("te", "")}},
+	} {
+		res, err := st.http2(requestParam{
+			name:   fmt.Sprintf("TestH2H1TE-%v", i),
+			header: tc.header,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if tc.ok {
+			if got, want := res.status, 200; got != want {
+				t.Errorf("%v: status: %v; want %v", tc.header, got, want)
+			}
+			continue
+		}
+		if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+			t.Errorf("%v: res.errCode = %v; want %v", tc.header, got, want)
+		}
+	}
+}
+
+// TestH2H1ConnectionSpecificHeaders tests that server resets the
+// stream with PROTOCOL_ERROR if request has connection-specific
+// header field, which is not allowed in HTTP/2.
+func TestH2H1ConnectionSpecificHeaders(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	for _, h := range []hpack.HeaderField{
+		pair("connection", "close"),
+		pair("keep-alive", "timeout=5"),
+		pair("proxy-connection", "keep-alive"),
+		pair("transfer-encoding", "chunked"),
+		pair("upgrade", "websocket"),
+	} {
+		res, err := st.http2(requestParam{
+			name:   "TestH2H1ConnectionSpecificHeaders-" + h.Name,
+			header: []hpack.HeaderField{h},
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+			t.Errorf("%v: res.errCode = %v; want %v", h.Name, got, want)
+		}
+	}
+}
+
+// TestH2H1ContentLengthMismatch tests that server resets the stream
+// with PROTOCOL_ERROR if the length of request body disagrees with
+// content-length, whether body is shorter or longer.
+func TestH2H1ContentLengthMismatch(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	for _, tc := range []struct {
+		contentLength string
+		body          []byte
+	}{
+		{contentLength: "100", body: make([]byte, 50)},
+		{contentLength: "5", body: []byte("hello world")},
+	} {
+		res, err := st.http2(requestParam{
+			name:          "TestH2H1ContentLengthMismatch-" + tc.contentLength,
+			method:        "POST",
+			contentLength: tc.contentLength,
+			body:          tc.body,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+			t.Errorf("content-length %v, body %v bytes: res.errCode = %v; want %v", tc.contentLength, len(tc.body), got, want)
+		}
+	}
+}
+
+// TestH2H1ResponseShorterThanContentLength tests that server resets
+// the stream with PROTOCOL_ERROR if backend closes the connection
+// before sending as many bytes of response body as Content-Length
+// says.
+func TestH2H1ResponseShorterThanContentLength(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ResponseShorterThanContentLength",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode = %v; want %v", got, want)
+	}
+}
+
+// TestH2H1ResponseLongerThanContentLength tests that server truncates
+// response body at Content-Length if backend sends more.
+func TestH2H1ResponseLongerThanContentLength(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello world"))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ResponseLongerThanContentLength",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if res.reset {
+		t.Errorf("res.reset = true; want false; errCode = %v", res.errCode)
+	}
+	st.assertResponse(res, 200, map[string]string{"content-length": "5"}, []byte("hello"))
+}
+
+// TestH2H1ContentEncodingPassthrough tests that server forwards
+// Accept-Encoding to backend, and response body compressed by backend
+// to client, without decompressing or recompressing it.
+func TestH2H1ContentEncodingPassthrough(t *testing.T) {
+	body := gzipBytes([]byte("hello world"))
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ContentEncodingPassthrough",
+		header: []hpack.HeaderField{
+			pair("accept-encoding", "gzip, deflate"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertBackendHeader("Accept-Encoding", "gzip, deflate")
+	st.assertResponse(res, 200, map[string]string{"content-encoding": "gzip"}, body)
+
+	decoded, err := gunzipBytes(res.body)
+	if err != nil {
+		t.Fatalf("Error gunzipBytes() = %v", err)
+	}
+	if got, want := string(decoded), "hello world"; got != want {
+		t.Errorf("decoded body: %q; want %q", got, want)
+	}
+}
+
+// TestH2H1EarlyHints tests that server forwards 103 Early Hints from
+// backend as interim response with Link header field, ahead of the
+// final response.
+func TestH2H1EarlyHints(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </style.css>; rel=preload\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1EarlyHints",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := len(res.interimResponses), 1; got != want {
+		t.Fatalf("len(res.interimResponses) = %v; want %v", got, want)
+	}
+	hint := res.interimResponses[0]
+	if got, want := hint.status, 103; got != want {
+		t.Errorf("interim status: %v; want %v", got, want)
+	}
+	if got, want := hint.header.Get("link"), "</style.css>; rel=preload"; got != want {
+		t.Errorf("interim link: %v; want %v", got, want)
+	}
+	st.assertResponse(res, 200, nil, []byte("hello"))
+}
+
+// TestH2H1MultipleEarlyHints tests that server forwards several 103
+// Early Hints responses, each of which may have multiple Link header
+// fields, in the order backend sent them.  nghttpx in this tree does
+// not generate Early Hints by itself; it only forwards them.
+func TestH2H1MultipleEarlyHints(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </a.css>; rel=preload\r\n\r\n"+
+		"HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </b.js>; rel=preload\r\n"+
+		"Link: </c.png>; rel=preload\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1MultipleEarlyHints",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertEarlyHints(res, [][]string{
+		{"</a.css>; rel=preload"},
+		{"</b.js>; rel=preload", "</c.png>; rel=preload"},
+	})
+	if got, want := len(res.interimResponses), 3; got != want {
+		t.Errorf("len(res.interimResponses) = %v; want %v", got, want)
+	}
+	st.assertResponse(res, 200, nil, []byte("hello"))
+}
+
+// TestH2H1HeaderRewrite tests that server adds and removes header
+// fields in both request and response.
+func TestH2H1HeaderRewrite(t *testing.T) {
+	st := newServerTester([]string{"--add-response-header=foo: bar"}, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Keep-Alive", "timeout=5")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1HeaderRewrite",
+		header: []hpack.HeaderField{
+			pair("x-forwarded-proto", "https"),
+			pair("http2-settings", "AAMAAABkAAQAAP__"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+
+	// X-Forwarded-Proto from client is replaced with the one
+	// generated by server.
+	st.assertBackendHeader("X-Forwarded-Proto", "http")
+	st.assertNoBackendHeader("Http2-Settings")
+
+	st.assertResponse(res, 200, map[string]string{"foo": "bar"}, nil)
+	st.assertNoResponseHeader(res, "Keep-Alive")
+}
+
+// TestH2H1HopByHopHeaders tests that server strips hop-by-hop header
+// fields in HTTP/1 response from backend, which are not allowed in
+// HTTP/2, and that TE: trailers in request is forwarded to backend.
+// Header fields nominated by Connection are forwarded as is.
+func TestH2H1HopByHopHeaders(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Custom")
+		w.Header().Set("Proxy-Connection", "keep-alive")
+		w.Header().Set("X-Custom", "foo")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1HopByHopHeaders",
+		header: []hpack.HeaderField{
+			pair("te", "trailers"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertBackendHeader("Te", "trailers")
+
+	st.assertResponse(res, 200, map[string]string{"x-custom": "foo"}, nil)
+	st.assertNoResponseHeader(res, "connection")
+	st.assertNoResponseHeader(res, "proxy-connection")
+}
+
+// TestH2H1GracefulShutdownInFlight tests that the stream in flight is
+// completed during graceful shutdown, and the stream created after
+// the final GOAWAY is not processed.
+func TestH2H1GracefulShutdownInFlight(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	sh1, err := st.http2Begin(requestParam{
+		name: "TestH2H1GracefulShutdownInFlight-1",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Begin() = %v", err)
+	}
+
+	if _, err := st.gracefulShutdown(); err != nil {
+		t.Fatalf("Error st.gracefulShutdown() = %v", err)
+	}
+
+	f, err := st.waitGoAway(func(f *http2.GoAwayFrame) bool {
+		return f.LastStreamID != maxStreamID
+	})
+	if err != nil {
+		t.Fatalf("Error st.waitGoAway() = %v", err)
+	}
+	if got, want := f.ErrCode, http2.ErrCodeNo; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+	if got, want := f.LastStreamID, sh1.res.streamID; got != want {
+		t.Errorf("f.LastStreamID: %v; want %v", got, want)
+	}
+
+	sh2, err := st.http2Async(requestParam{
+		name: "TestH2H1GracefulShutdownInFlight-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+
+	if err := sh1.SendData(nil, true); err != nil {
+		t.Fatalf("Error sh1.SendData() = %v", err)
+	}
+	res, err := sh1.Response()
+	if err != nil {
+		t.Fatalf("Error sh1.Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	// server closes connection after stream 1 is completed
+	if res, err := sh2.Response(); err == nil {
+		t.Errorf("sh2.Response() = %v, nil; want error", res.status)
+	}
+}
+
+// TestH2H1ConfigFile tests that server reads options from
+// configuration file given in --conf.
+func TestH2H1ConfigFile(t *testing.T) {
+	st := newServerTesterConfig([]string{
+		"# comment line is ignored",
+		"add-response-header=foo: bar",
+		"no-via=yes",
+	}, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1ConfigFile",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertResponse(res, 200, map[string]string{"foo": "bar"}, nil)
+	st.assertNoResponseHeader(res, "Via")
+}
+
+// TestH2H1DataOnIdleStream tests that server treats DATA on idle
+// stream as connection error.  nghttp2 uses STREAM_CLOSED for it,
+// instead of PROTOCOL_ERROR required by RFC 7540.
+func TestH2H1DataOnIdleStream(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward request")
+	})
+	defer st.Close()
+
+	if err := st.writeDataOnStream(99, []byte("foo"), true); err != nil {
+		t.Fatalf("Error st.writeDataOnStream() = %v", err)
+	}
+
+	frames, err := st.readFrames(func(f http2.Frame) bool {
+		_, ok := f.(*http2.GoAwayFrame)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+	f := frames[len(frames)-1].(*http2.GoAwayFrame)
+	if got, want := f.ErrCode, http2.ErrCodeStreamClosed; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1GoAwayLastStreamID tests that GOAWAY sent on connection
+// error carries the highest stream ID server has processed, including
+// the stream whose response is still pending.
+func TestH2H1GoAwayLastStreamID(t *testing.T) {
+	release := make(chan struct{})
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	})
+	defer st.Close()
+	defer close(release)
+
+	for i := 0; i < 2; i++ {
+		res, err := st.http2(requestParam{
+			name: fmt.Sprintf("TestH2H1GoAwayLastStreamID-%v", i),
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("status: %v; want %v", got, want)
+		}
+	}
+
+	sh, err := st.http2Async(requestParam{
+		name: "TestH2H1GoAwayLastStreamID-slow",
+		path: "/slow",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+	if err := st.writeDataOnStream(sh.res.streamID+2, []byte("foo"), true); err != nil {
+		t.Fatalf("Error st.writeDataOnStream() = %v", err)
+	}
+
+	responses, f, err := st.http2UntilGoAway()
+	if err != nil {
+		t.Fatalf("Error st.http2UntilGoAway() = %v", err)
+	}
+	if got, want := f.ErrCode, http2.ErrCodeStreamClosed; got != want {
+		t.Errorf("f.ErrCode: %v; want %v", got, want)
+	}
+	if got, want := f.LastStreamID, sh.res.streamID; got != want {
+		t.Errorf("f.LastStreamID: %v; want %v", got, want)
+	}
+	if got, want := len(responses), 1; got != want {
+		t.Fatalf("len(responses): %v; want %v", got, want)
+	}
+	res := responses[sh.res.streamID]
+	if got, want := res.status, 0; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if !res.connErr {
+		t.Errorf("res.connErr = false; want true")
+	}
+}
+
+// TestH2H1DataOnHalfClosedStream tests that server treats DATA on the
+// stream in half-closed (remote) state as connection error
+// STREAM_CLOSED.
+func TestH2H1DataOnHalfClosedStream(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		// keep the stream half-closed (remote) state
+		time.Sleep(time.Second)
+	})
+	defer st.Close()
+
+	sh, err := st.http2Async(requestParam{
+		name: "TestH2H1DataOnHalfClosedStream",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+
+	if err := st.writeDataOnStream(sh.res.streamID, []byte("foo"), true); err != nil {
+		t.Fatalf("Error st.writeDataOnStream() = %v", err)
+	}
+
+	res, err := sh.Response()
+	if err != nil {
+		t.Fatalf("Error sh.Response() = %v", err)
+	}
+	if got, want := res.connErr, true; got != want {
+		t.Errorf("res.connErr: %v; want %v", got, want)
+	}
+	if got, want := res.errCode, http2.ErrCodeStreamClosed; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1DataOnClosedStream tests that server ignores DATA on closed
+// stream, and the connection is still usable.
+func TestH2H1DataOnClosedStream(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1DataOnClosedStream-1",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+
+	if err := st.writeDataOnStream(res.streamID, []byte("foo"), true); err != nil {
+		t.Fatalf("Error st.writeDataOnStream() = %v", err)
+	}
+
+	res, err = st.http2(requestParam{
+		name: "TestH2H1DataOnClosedStream-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1EvenStreamID tests that server treats request HEADERS on
+// even-numbered stream as connection error.
+func TestH2H1EvenStreamID(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("server should not forward bad request")
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:     "TestH2H1EvenStreamID",
+		streamID: 2,
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.connErr, true; got != want {
+		t.Errorf("res.connErr: %v; want %v", got, want)
+	}
+	if got, want := res.errCode, http2.ErrCodeProtocol; got != want {
+		t.Errorf("res.errCode: %v; want %v", got, want)
+	}
+	if got, want := st.nextStreamID, uint32(1); got != want {
+		t.Errorf("st.nextStreamID: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1NonIncreasingStreamID tests that server ignores request
+// HEADERS on the stream ID which is not larger than the ones used so
+// far.  RFC 7540 requires connection error PROTOCOL_ERROR, but nghttp2
+// ignores them because trailer may arrive on the stream which server
+// has reset.
+func TestH2H1NonIncreasingStreamID(t *testing.T) {
+	tests := []struct {
+		desc       string
+		usedID     uint32
+		reusedID   uint32
+		nextStream uint32
+	}{
+		{desc: "reuse same ID", usedID: 1, reusedID: 1, nextStream: 3},
+		{desc: "go backwards", usedID: 5, reusedID: 3, nextStream: 7},
+	}
+
+	for _, tt := range tests {
+		st := newServerTester(nil, t, noopHandler)
+
+		res, err := st.http2(requestParam{
+			name:     "TestH2H1NonIncreasingStreamID-used",
+			streamID: tt.usedID,
+		})
+		if err != nil {
+			st.Close()
+			t.Fatalf("%v: Error st.http2() = %v", tt.desc, err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", tt.desc, got, want)
+		}
+
+		ignored, err := st.http2Async(requestParam{
+			name:     "TestH2H1NonIncreasingStreamID-reused",
+			streamID: tt.reusedID,
+		})
+		if err != nil {
+			st.Close()
+			t.Fatalf("%v: Error st.http2Async() = %v", tt.desc, err)
+		}
+
+		// the next stream is served normally
+		sh, err := st.http2Async(requestParam{
+			name: "TestH2H1NonIncreasingStreamID-next",
+		})
+		if err != nil {
+			st.Close()
+			t.Fatalf("%v: Error st.http2Async() = %v", tt.desc, err)
+		}
+		if got, want := sh.res.streamID, tt.nextStream; got != want {
+			t.Errorf("%v: sh.res.streamID: %v; want %v", tt.desc, got, want)
+		}
+		res, err = sh.Response()
+		if err != nil {
+			st.Close()
+			t.Fatalf("%v: Error sh.Response() = %v", tt.desc, err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", tt.desc, got, want)
+		}
+
+		if len(ignored.frames) != 0 || ignored.closed {
+			t.Errorf("%v: server responded to stream %v", tt.desc, tt.reusedID)
+		}
+
+		st.Close()
+	}
+}
+
+// TestH2H1RapidReset tests that server survives many streams reset
+// right after they are opened, and still serves the connection.
+// nghttpx has no mitigation against this abuse yet, so it neither
+// limits the rate nor sends GOAWAY.
+func TestH2H1RapidReset(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	ids, err := st.rapidReset("TestH2H1RapidReset-reset", 100)
+	if err != nil {
+		t.Fatalf("Error st.rapidReset() = %v", err)
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1RapidReset",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if res.connErr {
+		t.Fatalf("res.connErr = true after %v streams are reset; want false", len(ids))
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1EmptyDataEndStream tests that server accepts request whose
+// END_STREAM is carried by empty DATA frame, optionally preceded by
+// other empty DATA frames.
+func TestH2H1EmptyDataEndStream(t *testing.T) {
+	st := newServerTester(nil, t, readBodyHandler)
+	defer st.Close()
+
+	tests := []struct {
+		name      string
+		body      []byte
+		emptyData int
+	}{
+		{name: "TestH2H1EmptyDataEndStream-1", emptyData: 1},
+		{name: "TestH2H1EmptyDataEndStream-3", emptyData: 3},
+		{name: "TestH2H1EmptyDataEndStream-body", body: []byte("foo"), emptyData: 3},
+	}
+
+	for _, tt := range tests {
+		res, err := st.http2(requestParam{
+			name:      tt.name,
+			method:    "POST",
+			body:      tt.body,
+			emptyData: tt.emptyData,
+		})
+		if err != nil {
+			t.Fatalf("%v: Error st.http2() = %v", tt.name, err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", tt.name, got, want)
+		}
+
+		br := st.backendRequest(tt.name)
+		if br == nil {
+			t.Errorf("%v: backend did not receive request", tt.name)
+			continue
+		}
+		if got, want := string(br.body), string(tt.body); got != want {
+			t.Errorf("%v: backend request body: %q; want %q", tt.name, got, want)
+		}
+	}
+}
+
+// TestH2H1LargeHeader tests that server responds with 431 if the
+// total size of request header fields exceeds 32KiB, which is fixed
+// in nghttpx.
+func TestH2H1LargeHeader(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	tests := []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{name: "TestH2H1LargeHeader-16K", size: 16 * 1024, status: 200},
+		// HPACK in nghttp2 rejects a value larger than 64KiB as
+		// COMPRESSION_ERROR, so 40KiB is used.
+		{name: "TestH2H1LargeHeader-40K", size: 40 * 1024, status: 431},
+	}
+
+	for _, tt := range tests {
+		res, err := st.http2(requestParam{
+			name: tt.name,
+			header: []hpack.HeaderField{
+				pair("cookie", headerValueOfSize(tt.size)),
+			},
+		})
+		if err != nil {
+			t.Fatalf("%v: Error st.http2() = %v", tt.name, err)
+		}
+		if got, want := res.status, tt.status; got != want {
+			t.Errorf("%v: status: %v; want %v", tt.name, got, want)
+		}
+	}
+
+	if !st.errorLogContains("Too large header block size=") {
+		t.Errorf("error log does not contain too large header block")
+	}
+}
+
+// TestH2H1ManyHeaderFields tests that server does not limit the
+// number of request header fields, but their total size.  Each field
+// generated by manyHeaderFields takes 14 bytes.
+func TestH2H1ManyHeaderFields(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	tests := []struct {
+		name   string
+		n      int
+		status int
+	}{
+		{name: "TestH2H1ManyHeaderFields-1000", n: 1000, status: 200},
+		{name: "TestH2H1ManyHeaderFields-3000", n: 3000, status: 431},
+	}
+
+	for _, tt := range tests {
+		res, err := st.http2(requestParam{
+			name:   tt.name,
+			header: manyHeaderFields(tt.n),
+		})
+		if err != nil {
+			t.Fatalf("%v: Error st.http2() = %v", tt.name, err)
+		}
+		if got, want := res.status, tt.status; got != want {
+			t.Errorf("%v: status: %v; want %v", tt.name, got, want)
+		}
+		if tt.status != 200 {
+			continue
+		}
+		br := st.backendRequest(tt.name)
+		if br == nil {
+			t.Errorf("%v: backend did not receive request", tt.name)
+			continue
+		}
+		for _, hf := range manyHeaderFields(tt.n) {
+			if got := br.header.Get(hf.Name); got != hf.Value {
+				t.Errorf("%v: %v: %q; want %q", tt.name, hf.Name, got, hf.Value)
+				break
+			}
+		}
+	}
+}
+
+// TestH2H1AccessLog tests that server writes the request and its
+// status code in access log.
+func TestH2H1AccessLog(t *testing.T) {
+	st := newServerTester([]string{"--accesslog-format=$status $request"}, t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notfound" {
+			http.NotFound(w, r)
+		}
+	})
+	defer st.Close()
+
+	for _, rp := range []requestParam{
+		{name: "TestH2H1AccessLog-1", path: "/alpha"},
+		{name: "TestH2H1AccessLog-2", method: "POST", path: "/notfound", body: []byte("foo")},
+	} {
+		if _, err := st.http2(rp); err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+	}
+
+	lines, err := st.readAccessLog()
+	if err != nil {
+		t.Fatalf("Error st.readAccessLog() = %v", err)
+	}
+	want := []string{
+		"200 GET /alpha HTTP/2.0",
+		"404 POST /notfound HTTP/2.0",
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("access log: %q; want %q", lines, want)
+	}
+}
+
+// TestH2H1RepeatedReadTimeout tests that read timeouts neither leak
+// goroutines nor lose the frames arriving after them.
+func TestH2H1RepeatedReadTimeout(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if _, err := st.http2(requestParam{
+		name: "TestH2H1RepeatedReadTimeout-1",
+	}); err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+
+	n := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if err := st.expectNoFrame(10 * time.Millisecond); err != nil {
+			t.Fatalf("Error st.expectNoFrame() = %v", err)
+		}
+	}
+	if got := runtime.NumGoroutine(); got-n >= 10 {
+		t.Errorf("runtime.NumGoroutine() = %v after 50 timeouts; want about %v", got, n)
+	}
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1RepeatedReadTimeout-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1StreamingResponse tests that server forwards response body
+// from backend as it arrives, without buffering whole body.
+func TestH2H1StreamingResponse(t *testing.T) {
+	next := make(chan struct{})
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("world"))
+	})
+	defer st.Close()
+
+	sh, err := st.http2Async(requestParam{
+		name: "TestH2H1StreamingResponse",
+	})
+	if err != nil {
+		close(next)
+		t.Fatalf("Error st.http2Async() = %v", err)
+	}
+
+	data, end, err := st.http2RecvData(sh.res.streamID)
+	close(next)
+	if err != nil {
+		t.Fatalf("Error st.http2RecvData() = %v", err)
+	}
+	if got, want := string(data), "hello"; got != want {
+		t.Errorf("data = %q; want %q", got, want)
+	}
+	if end {
+		t.Fatalf("first DATA ended stream")
+	}
+
+	var rest []byte
+	for !end {
+		if data, end, err = st.http2RecvData(sh.res.streamID); err != nil {
+			t.Fatalf("Error st.http2RecvData() = %v", err)
+		}
+		rest = append(rest, data...)
+	}
+	if got, want := string(rest), "world"; got != want {
+		t.Errorf("rest = %q; want %q", got, want)
+	}
+	if got, want := sh.res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1AuthorityToHost tests that server generates Host header
+// field from :authority when request does not have Host.
+func TestH2H1AuthorityToHost(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:      "TestH2H1AuthorityToHost",
+		authority: "authority.example.org",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertBackendHost("authority.example.org")
+}
+
+// TestH2H1AuthorityAndConflictingHost tests that server forwards Host
+// header field as is when request has both :authority and Host with
+// different values.  Host is generated from :authority only if it is
+// missing, so Host wins, although RFC 7540 says that :authority
+// should be used in this case.
+func TestH2H1AuthorityAndConflictingHost(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:      "TestH2H1AuthorityAndConflictingHost",
+		authority: "authority.example.org",
+		header: []hpack.HeaderField{
+			pair("host", "host.example.org"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertBackendHost("host.example.org")
+}
+
+// TestH2H1PathAsIs tests that server forwards :path to backend as
+// is, without resolving dot segments or decoding percent-encoded
+// octets, and that query is preserved.
+func TestH2H1PathAsIs(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	for i, path := range []string{
+		"/a/../b",
+		"/%2e%2e/",
+		"/a%2Fb",
+		"/a/./b?x=%2F&y=/../&z",
+	} {
+		res, err := st.http2(requestParam{
+			name: fmt.Sprintf("TestH2H1PathAsIs-%v", i),
+			path: path,
+		})
+		if err != nil {
+			t.Fatalf("Error st.http2() = %v", err)
+		}
+		if got, want := res.status, 200; got != want {
+			t.Errorf("%v: status: %v; want %v", path, got, want)
+		}
+		st.assertBackendRequestURI(path)
+	}
+}
+
+// TestH2H1GETWithBody tests that server forwards request body of GET
+// request to backend unchanged.
+func TestH2H1GETWithBody(t *testing.T) {
+	st := newServerTester(nil, t, readBodyHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1GETWithBody",
+		method: "GET",
+		body:   []byte("hello world"),
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	req := st.backendRequest("TestH2H1GETWithBody")
+	if req == nil {
+		t.Fatalf("backend did not receive request")
+	}
+	if got, want := req.method, "GET"; got != want {
+		t.Errorf("backend request method: %v; want %v", got, want)
+	}
+	if got, want := string(req.body), "hello world"; got != want {
+		t.Errorf("backend request body: %q; want %q", got, want)
+	}
+}
+
+// TestH2H1HEAD tests that server ends the stream on HEADERS without
+// DATA for HEAD request, while keeping Content-Length which GET would
+// have, even if backend sends body.  net/http backend server never
+// sends body for HEAD request, so rawHandler is used.
+func TestH2H1HEAD(t *testing.T) {
+	st := newServerTester(nil, t, rawHandler("HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world"))
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1HEAD-1",
+		method: "HEAD",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := res.header.Get("content-length"), "11"; got != want {
+		t.Errorf("content-length: %v; want %v", got, want)
+	}
+	if got := len(res.body); got != 0 {
+		t.Errorf("len(body): %v; want 0", got)
+	}
+	if !res.headersEndStream {
+		t.Errorf("stream did not end with HEADERS")
+	}
+
+	res, err = st.http2(requestParam{
+		name: "TestH2H1HEAD-2",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertResponse(res, 200, nil, []byte("hello world"))
+}
+
+// TestH2H1NotModified tests that server forwards 304 response with
+// END_STREAM in HEADERS, without DATA, and that If-None-Match is
+// forwarded to backend.
+func TestH2H1NotModified(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"foo"`)
+		if r.Header.Get("If-None-Match") == `"foo"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1NotModified",
+		header: []hpack.HeaderField{
+			pair("if-none-match", `"foo"`),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertBackendHeader("if-none-match", `"foo"`)
+	if got, want := res.status, 304; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := res.header.Get("etag"), `"foo"`; got != want {
+		t.Errorf("etag: %v; want %v", got, want)
+	}
+	if got := len(res.body); got != 0 {
+		t.Errorf("len(body): %v; want 0", got)
+	}
+	// no DATA, not even empty one, follows
+	if !res.headersEndStream {
+		t.Errorf("stream did not end with HEADERS")
+	}
+}
+
+// TestH2H1IPv6 tests that server accepts connection on IPv6 frontend
+// address, and forwards request to IPv6 backend address.
+func TestH2H1IPv6(t *testing.T) {
+	st := newServerTesterIPv6([]string{"--add-x-forwarded-for"}, t, noopHandler)
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name: "TestH2H1IPv6",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	st.assertForwardedFor("::1")
+}
+
+// TestH2H1WithRetry tests that st.withRetry retries the request on
+// new connection after timeout waiting for frame, and succeeds once
+// backend server stops stalling.
+func TestH2H1WithRetry(t *testing.T) {
+	var calls int32
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(time.Second)
+		}
+	})
+	defer st.Close()
+
+	st.readTimeout = 200 * time.Millisecond
+
+	attempts := 0
+	res, err := st.withRetry(3, func() (*serverResponse, error) {
+		attempts++
+		return st.http2(requestParam{
+			name: "TestH2H1WithRetry",
+		})
+	})
+	if err != nil {
+		t.Fatalf("Error st.withRetry() = %v", err)
+	}
+	if got, want := attempts, 2; got != want {
+		t.Errorf("attempts = %v; want %v", got, want)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1WithRetryGiveUp tests that st.withRetry gives up after
+// attempts tries if the error persists, and returns the last error.
+// The error which is not transient is returned without retry.
+func TestH2H1WithRetryGiveUp(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	})
+	defer st.Close()
+
+	st.readTimeout = 200 * time.Millisecond
+
+	attempts := 0
+	_, err := st.withRetry(3, func() (*serverResponse, error) {
+		attempts++
+		return st.http2(requestParam{
+			name: "TestH2H1WithRetryGiveUp",
+		})
+	})
+	if err != errReadTimeout {
+		t.Errorf("st.withRetry() = %v; want %v", err, errReadTimeout)
+	}
+	if got, want := attempts, 3; got != want {
+		t.Errorf("attempts = %v; want %v", got, want)
+	}
+
+	errPermanent := errors.New("permanent error")
+	attempts = 0
+	_, err = st.withRetry(3, func() (*serverResponse, error) {
+		attempts++
+		return nil, errPermanent
+	})
+	if err != errPermanent {
+		t.Errorf("st.withRetry() = %v; want %v", err, errPermanent)
+	}
+	if got, want := attempts, 1; got != want {
+		t.Errorf("attempts = %v; want %v", got, want)
+	}
+}
+
 // TestH2H1AddXff tests that server generates X-Forwarded-For header
 // field when forwarding request to backend.
 func TestH2H1AddXff(t *testing.T) {
@@ -260,7 +3133,7 @@ func TestH2H1LocationRewrite(t *testing.T) {
 		t.Fatalf("Error st.http2() = %v", err)
 	}
 
-	want := fmt.Sprintf("http://127.0.0.1:%v/p/q?a=b#fragment", serverPort)
+	want := fmt.Sprintf("http://%v/p/q?a=b#fragment", st.authority)
 	if got := res.header.Get("Location"); got != want {
 		t.Errorf("Location: %v; want %v", got, want)
 	}
@@ -445,6 +3318,201 @@ func TestH2H1SNI(t *testing.T) {
 	}
 }
 
+// TestH2H1SNIFallback tests that server selects the default
+// certificate if client does not send TLS SNI, or indicates host name
+// which does not match any certificate.
+func TestH2H1SNIFallback(t *testing.T) {
+	for _, serverName := range []string{"", "unknown-domain"} {
+		st := newServerTesterTLSConfig([]string{"--subcert=" + testDir + "/alt-server.key:" + testDir + "/alt-server.crt"}, t, noopHandler, &tls.Config{
+			ServerName: serverName,
+		})
+
+		cs, _ := st.tlsConnectionState()
+		cert := cs.PeerCertificates[0]
+
+		if got, want := cert.Subject.CommonName, "127.0.0.1"; got != want {
+			t.Errorf("ServerName %q: CommonName: %v; want %v", serverName, got, want)
+		}
+
+		st.Close()
+	}
+}
+
+// TestH2H1NegotiatedProto tests that server negotiates h2-14 by
+// default.
+func TestH2H1NegotiatedProto(t *testing.T) {
+	st := newServerTesterTLS(nil, t, noopHandler)
+	defer st.Close()
+
+	if got, want := st.negotiatedProto, "h2-14"; got != want {
+		t.Errorf("st.negotiatedProto: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1TLSClientCert tests that server accepts client which
+// presents certificate signed by CA given in --verify-client-cacert.
+func TestH2H1TLSClientCert(t *testing.T) {
+	st := newServerTesterTLSMutual([]string{"--verify-client", "--verify-client-cacert=" + testDir + "/server.crt"}, t, noopHandler, testDir+"/server.crt", testDir+"/server.key")
+	defer st.Close()
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1TLSClientCert",
+		scheme: "https",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1TLSProtocolAndCipher tests that server negotiates TLS
+// version and cipher suite given in --tls-proto-list and --ciphers.
+func TestH2H1TLSProtocolAndCipher(t *testing.T) {
+	st := newServerTesterTLS([]string{"--tls-proto-list=TLSv1.2", "--ciphers=ECDHE-RSA-AES128-GCM-SHA256"}, t, noopHandler)
+	defer st.Close()
+
+	cs, ok := st.tlsConnectionState()
+	if !ok {
+		t.Fatalf("st.tlsConnectionState(): connection is not TLS")
+	}
+	if got, want := cs.Version, uint16(tls.VersionTLS12); got != want {
+		t.Errorf("cs.Version: %#x; want %#x", got, want)
+	}
+	if got, want := cs.CipherSuite, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; got != want {
+		t.Errorf("cs.CipherSuite: %#x; want %#x", got, want)
+	}
+}
+
+// TestH2H1TLSSessionResumption tests that server resumes TLS session
+// using session ticket, and negotiates the same protocol.
+func TestH2H1TLSSessionResumption(t *testing.T) {
+	st := newServerTesterTLSConfig(nil, t, noopHandler, &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	})
+	defer st.Close()
+
+	if cs, _ := st.tlsConnectionState(); cs.DidResume {
+		t.Errorf("cs.DidResume = true in the first handshake; want false")
+	}
+
+	if err := st.reconnect(); err != nil {
+		t.Fatalf("Error st.reconnect() = %v", err)
+	}
+
+	cs, _ := st.tlsConnectionState()
+	if !cs.DidResume {
+		t.Errorf("cs.DidResume = false; want true")
+	}
+	if got, want := st.negotiatedProto, "h2-14"; got != want {
+		t.Errorf("st.negotiatedProto: %v; want %v", got, want)
+	}
+
+	res, err := st.http2(requestParam{
+		name:   "TestH2H1TLSSessionResumption",
+		scheme: "https",
+	})
+	if err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestH2H1NoOCSPStaple tests that server does not staple OCSP
+// response, since OCSP stapling is not supported yet.
+func TestH2H1NoOCSPStaple(t *testing.T) {
+	st := newServerTesterTLS(nil, t, noopHandler)
+	defer st.Close()
+
+	if got := st.ocspStaple(); got != nil {
+		t.Errorf("st.ocspStaple() = %x; want nil", got)
+	}
+}
+
+// TestH2H1PlainTLSConnectionState tests that
+// serverTester.tlsConnectionState returns false for plain TCP
+// frontend connection.
+func TestH2H1PlainTLSConnectionState(t *testing.T) {
+	st := newServerTester(nil, t, noopHandler)
+	defer st.Close()
+
+	if _, ok := st.tlsConnectionState(); ok {
+		t.Errorf("st.tlsConnectionState(): ok = true; want false")
+	}
+}
+
+// TestH2H1RSTStreamCancel tests that server closes backend
+// connection when client cancels the stream in the middle of the
+// response.
+func TestH2H1RSTStreamCancel(t *testing.T) {
+	closed := make(chan bool, 1)
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 16384))
+		w.(http.Flusher).Flush()
+		select {
+		case <-w.(http.CloseNotifier).CloseNotify():
+			closed <- true
+		case <-time.After(5 * time.Second):
+			closed <- false
+		}
+	})
+	defer st.Close()
+
+	if _, err := st.writeHTTP2Request(requestParam{
+		name: "TestH2H1RSTStreamCancel",
+	}, true); err != nil {
+		t.Fatalf("Error st.writeHTTP2Request() = %v", err)
+	}
+
+	if _, err := st.readFrames(func(fr http2.Frame) bool {
+		f, ok := fr.(*http2.DataFrame)
+		return ok && f.StreamID == 1
+	}); err != nil {
+		t.Fatalf("Error st.readFrames() = %v", err)
+	}
+
+	if err := st.writeRSTStream(1, http2.ErrCodeCancel); err != nil {
+		t.Fatalf("Error st.writeRSTStream() = %v", err)
+	}
+
+	if !<-closed {
+		t.Errorf("backend connection was not closed after RST_STREAM")
+	}
+}
+
+// TestH2H1ClientGoAway tests that server finishes in-flight stream
+// after client sends GOAWAY.
+func TestH2H1ClientGoAway(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	defer st.Close()
+
+	if _, err := st.writeHTTP2Request(requestParam{
+		name: "TestH2H1ClientGoAway",
+	}, true); err != nil {
+		t.Fatalf("Error st.writeHTTP2Request() = %v", err)
+	}
+
+	if err := st.writeGoAway(0, http2.ErrCodeNo, []byte("client shutdown")); err != nil {
+		t.Fatalf("Error st.writeGoAway() = %v", err)
+	}
+
+	res, err := st.readHTTP2Response(&serverResponse{streamID: 1})
+	if err != nil {
+		t.Fatalf("Error st.readHTTP2Response() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+	if got, want := string(res.body), "hello"; got != want {
+		t.Errorf("body: %v; want %v", got, want)
+	}
+}
+
 // TestH2H1GracefulShutdown tests graceful shutdown.
 func TestH2H1GracefulShutdown(t *testing.T) {
 	st := newServerTester(nil, t, noopHandler)
@@ -522,6 +3590,58 @@ func TestH2H1GracefulShutdown(t *testing.T) {
 	}
 }
 
+// TestH2H1FrameSequence tests that server sends response HEADERS
+// followed by DATA which ends the stream.
+func TestH2H1FrameSequence(t *testing.T) {
+	st := newServerTester(nil, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	})
+	defer st.Close()
+
+	if _, err := st.writeHTTP2Request(requestParam{
+		name: "TestH2H1FrameSequence",
+	}, true); err != nil {
+		t.Fatalf("Error st.writeHTTP2Request() = %v", err)
+	}
+
+	frames, err := st.readFrames(func(fr http2.Frame) bool {
+		switch f := fr.(type) {
+		case *http2.HeadersFrame:
+			return f.StreamID == 1 && f.StreamEnded()
+		case *http2.DataFrame:
+			return f.StreamID == 1 && f.StreamEnded()
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatalf("st.readFrames(): %v", err)
+	}
+
+	var got []http2.FrameType
+	for _, f := range frames {
+		if f.Header().StreamID == 1 {
+			got = append(got, f.Header().Type)
+		}
+	}
+	if want := []http2.FrameType{http2.FrameHeaders, http2.FrameData}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("frame types on stream 1: %v; want %v", got, want)
+	}
+}
+
+// TestH2H2BackendProto tests that server forwards request to backend
+// in HTTP/2 if --http2-bridge is given.
+func TestH2H2BackendProto(t *testing.T) {
+	st := newServerTester([]string{"--http2-bridge"}, t, noopHandler)
+	defer st.Close()
+
+	if _, err := st.http2(requestParam{
+		name: "TestH2H2BackendProto",
+	}); err != nil {
+		t.Fatalf("Error st.http2() = %v", err)
+	}
+	st.assertBackendProto("HTTP/2.0")
+}
+
 // TestH2H2MultipleResponseCL tests that server returns error if
 // multiple Content-Length response header fields are received.
 func TestH2H2MultipleResponseCL(t *testing.T) {
@@ -1,12 +1,124 @@
 package nghttp2
 
 import (
+	"crypto/tls"
 	"github.com/bradfitz/http2/hpack"
 	"golang.org/x/net/spdy"
 	"net/http"
 	"testing"
+	"time"
 )
 
+// TestS3H1NegotiatedProto tests that server negotiates spdy/3.1
+// if it is the only protocol in --npn-list.
+func TestS3H1NegotiatedProto(t *testing.T) {
+	st := newServerTesterTLS([]string{"--npn-list=spdy/3.1"}, t, noopHandler)
+	defer st.Close()
+
+	if got, want := st.negotiatedProto, "spdy/3.1"; got != want {
+		t.Errorf("st.negotiatedProto: %v; want %v", got, want)
+	}
+}
+
+// TestS3H1ClientNextProtos tests that server negotiates spdy/3.1 if
+// client offers only spdy/3.1.
+func TestS3H1ClientNextProtos(t *testing.T) {
+	st := newServerTesterTLSConfig(nil, t, noopHandler, &tls.Config{
+		NextProtos: []string{"spdy/3.1"},
+	})
+	defer st.Close()
+
+	if got, want := st.negotiatedProto, "spdy/3.1"; got != want {
+		t.Errorf("st.negotiatedProto: %v; want %v", got, want)
+	}
+
+	res, err := st.spdy(requestParam{
+		name: "TestS3H1ClientNextProtos",
+	})
+	if err != nil {
+		t.Fatalf("Error st.spdy() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestS3H1Ping tests that server echoes back SPDY PING.
+func TestS3H1Ping(t *testing.T) {
+	st := newServerTesterTLS([]string{"--npn-list=spdy/3.1"}, t, noopHandler)
+	defer st.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := st.spdyPing(); err != nil {
+			t.Fatalf("Error st.spdyPing() = %v", err)
+		}
+	}
+
+	res, err := st.spdy(requestParam{
+		name: "TestS3H1Ping",
+	})
+	if err != nil {
+		t.Fatalf("Error st.spdy() = %v", err)
+	}
+	if got, want := res.status, 200; got != want {
+		t.Errorf("status: %v; want %v", got, want)
+	}
+}
+
+// TestS3H1ServerSettings tests that server advertises
+// SETTINGS_MAX_CONCURRENT_STREAMS and SETTINGS_INITIAL_WINDOW_SIZE.
+func TestS3H1ServerSettings(t *testing.T) {
+	st := newServerTesterTLS([]string{"--npn-list=spdy/3.1"}, t, noopHandler)
+	defer st.Close()
+
+	if _, err := st.spdy(requestParam{
+		name: "TestS3H1ServerSettings",
+	}); err != nil {
+		t.Fatalf("Error st.spdy() = %v", err)
+	}
+
+	for _, v := range []spdy.SettingsFlagIdValue{
+		{Id: spdy.SettingsMaxConcurrentStreams, Value: 100},
+		{Id: spdy.SettingsInitialWindowSize, Value: 65536},
+	} {
+		got, ok := st.spdyServerSettings[v.Id]
+		if !ok {
+			t.Errorf("SETTINGS %v is not advertised", v.Id)
+			continue
+		}
+		if got != v.Value {
+			t.Errorf("SETTINGS %v: %v; want %v", v.Id, got, v.Value)
+		}
+	}
+}
+
+// TestS3H1ClientInitialWindowSize tests that server does not send
+// response body beyond SETTINGS_INITIAL_WINDOW_SIZE sent by client.
+func TestS3H1ClientInitialWindowSize(t *testing.T) {
+	st := newServerTesterTLS([]string{"--npn-list=spdy/3.1"}, t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1024))
+	})
+	defer st.Close()
+
+	if err := st.spdyWriteSettings(spdy.SettingsFlagIdValue{
+		Id:    spdy.SettingsInitialWindowSize,
+		Value: 256,
+	}); err != nil {
+		t.Fatalf("Error st.spdyWriteSettings() = %v", err)
+	}
+
+	st.readTimeout = time.Second
+	res, err := st.spdy(requestParam{
+		name: "TestS3H1ClientInitialWindowSize",
+	})
+	if err != errReadTimeout {
+		t.Fatalf("st.spdy() = %v; want %v", err, errReadTimeout)
+	}
+	if got, want := len(res.body), 256; got != want {
+		t.Errorf("len(res.body): %v; want %v", got, want)
+	}
+}
+
 // TestS3H1PlainGET tests whether simple SPDY GET request works.
 func TestS3H1PlainGET(t *testing.T) {
 	st := newServerTesterTLS([]string{"--npn-list=spdy/3.1"}, t, noopHandler)
@@ -3,7 +3,11 @@ package nghttp2
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bradfitz/http2"
@@ -16,17 +20,35 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"os/exec"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
 const (
-	serverBin  = buildDir + "/src/nghttpx"
-	serverPort = 3009
-	testDir    = buildDir + "/integration-tests"
+	serverBin = buildDir + "/src/nghttpx"
+	testDir   = buildDir + "/integration-tests"
+	// errorLogPath is the error log file of nghttpx, which is
+	// shared by all tests.
+	errorLogPath = testDir + "/log.txt"
+	// loopbackIPv4 and loopbackIPv6 are the addresses which
+	// frontend and backend servers listen on.
+	loopbackIPv4 = "127.0.0.1"
+	loopbackIPv6 = "::1"
+	// h2cProtocol is HTTP/2 cleartext protocol identifier used in
+	// Upgrade header field.
+	h2cProtocol = "h2c-14"
+	// maxFrameSize is the default SETTINGS_MAX_FRAME_SIZE.
+	maxFrameSize = 16384
+	// defaultHeaderTableSize is the default
+	// SETTINGS_HEADER_TABLE_SIZE.
+	defaultHeaderTableSize = 4096
 )
 
 func pair(name, value string) hpack.HeaderField {
@@ -37,47 +59,145 @@ func pair(name, value string) hpack.HeaderField {
 }
 
 type serverTester struct {
-	args          []string  // command-line arguments
-	cmd           *exec.Cmd // test frontend server process, which is test subject
-	url           string    // test frontend server URL
-	t             *testing.T
-	ts            *httptest.Server // backend server
-	conn          net.Conn         // connection to frontend server
-	h2PrefaceSent bool             // HTTP/2 preface was sent in conn
-	nextStreamID  uint32           // next stream ID
-	fr            *http2.Framer    // HTTP/2 framer
-	spdyFr        *spdy.Framer     // SPDY/3.1 framer
-	headerBlkBuf  bytes.Buffer     // buffer to store encoded header block
-	enc           *hpack.Encoder   // HTTP/2 HPACK encoder
-	header        http.Header      // received header fields
-	dec           *hpack.Decoder   // HTTP/2 HPACK decoder
-	authority     string           // server's host:port
-	frCh          chan http2.Frame // used for incoming HTTP/2 frame
-	spdyFrCh      chan spdy.Frame  // used for incoming SPDY frame
-	errCh         chan error
+	args                   []string  // command-line arguments
+	cmd                    *exec.Cmd // test frontend server process, which is test subject
+	confPath               string    // configuration file given to cmd, which is removed by Close
+	accessLogPath          string    // access log file written by cmd, which is removed by Close
+	errorLogOffset         int64     // size of error log file before cmd is started
+	url                    string    // test frontend server URL
+	t                      *testing.T
+	ts                     *httptest.Server           // backend server, which is the first one of backends
+	backends               []*httptest.Server         // all backend servers
+	backendReqs            *backendRecorder           // requests received by backend server
+	tlsConfig              *tls.Config                // TLS configuration of frontend connection, nil if frontend is plain TCP
+	conn                   net.Conn                   // connection to frontend server
+	br                     *bufio.Reader              // buffered reader of conn for HTTP/1 response, created on first use
+	h1Closed               bool                       // HTTP/1 response with Connection: close was received, and conn is no longer usable
+	negotiatedProto        string                     // protocol negotiated by ALPN or NPN in TLS frontend connection
+	h2PrefaceSent          bool                       // HTTP/2 preface was sent in conn
+	settings               []http2.Setting            // SETTINGS sent in HTTP/2 preface
+	disablePush            bool                       // send SETTINGS_ENABLE_PUSH=0 in HTTP/2 preface in addition to settings
+	serverSettings         map[http2.SettingID]uint32 // SETTINGS advertised by server
+	spdyServerSettings     map[spdy.SettingsId]uint32 // SPDY SETTINGS advertised by server
+	manualWindowUpdate     bool                       // do not send WINDOW_UPDATE automatically for received DATA in HTTP/2
+	manualConnWindowUpdate bool                       // do not send connection-level WINDOW_UPDATE automatically in HTTP/2, while stream-level one is still sent unless manualWindowUpdate is true
+	connDataReceived       int                        // total length of DATA frames received in HTTP/2 connection
+	connRecvWindow         int                        // connection-level receive window of HTTP/2 connection, consumed by DATA read and replenished by WINDOW_UPDATE sent
+	settingsAckPending     int                        // number of HTTP/2 SETTINGS sent but not acknowledged by server yet
+	readTimeout            time.Duration              // timeout to read a frame, defaults to 5 seconds in HTTP/2 and 2 seconds in SPDY if 0
+	ignoreServerTableSize  bool                       // let setEncoderTableSize exceed SETTINGS_HEADER_TABLE_SIZE advertised by server
+	cancelPush             bool                       // reset pushed streams with CANCEL as soon as PUSH_PROMISE is received in HTTP/2
+	strictHeader           bool                       // validate pseudo header fields of HTTP/2 response, and record the result in serverResponse.headerError
+	nextStreamID           uint32                     // next stream ID
+	nextSpdyPingID         uint32                     // next SPDY PING ID, which is odd as client initiates it
+	fr                     *http2.Framer              // HTTP/2 framer
+	spdyFr                 *spdy.Framer               // SPDY/3.1 framer
+	headerBlkBuf           bytes.Buffer               // buffer to store encoded header block
+	enc                    *hpack.Encoder             // HTTP/2 HPACK encoder
+	header                 http.Header                // received header fields
+	headerFields           []hpack.HeaderField        // received header fields in the order of decoding
+	dec                    *hpack.Decoder             // HTTP/2 HPACK decoder
+	authority              string                     // server's host:port
+	handles                map[uint32]*streamHandle   // open streams created by http2Begin, keyed by stream ID
+	hblk                   pendingHeaderBlock         // header block being received by streamHandle.Recv
+	connDone               chan struct{}              // closed when conn is closed or replaced, which stops frame reader goroutine
+	readerProto            string                     // protocol read by frame reader goroutine, "HTTP/2" or "SPDY"; empty if it is not started
+	frReqCh                chan struct{}              // requests frame reader goroutine to read next frame
+	frPending              bool                       // a request to frame reader goroutine is outstanding
+	frErr                  error                      // error returned by frame reader goroutine, which has exited
+	frCh                   chan http2.Frame           // used for incoming HTTP/2 frame
+	spdyFrCh               chan spdy.Frame            // used for incoming SPDY frame
+	errCh                  chan error                 // used for error of frame reader goroutine
 }
 
 // newServerTester creates test context for plain TCP frontend
 // connection.
 func newServerTester(args []string, t *testing.T, handler http.HandlerFunc) *serverTester {
-	return newServerTesterInternal(args, t, handler, false, nil)
+	return newServerTesterInternal(args, t, []http.HandlerFunc{handler}, loopbackIPv4, false, nil)
 }
 
 // newServerTester creates test context for TLS frontend connection.
 func newServerTesterTLS(args []string, t *testing.T, handler http.HandlerFunc) *serverTester {
-	return newServerTesterInternal(args, t, handler, true, nil)
+	return newServerTesterInternal(args, t, []http.HandlerFunc{handler}, loopbackIPv4, true, nil)
 }
 
 // newServerTester creates test context for TLS frontend connection
-// with given clientConfig
+// with given clientConfig.  If clientConfig.NextProtos is empty,
+// h2-14 and spdy/3.1 are offered.
 func newServerTesterTLSConfig(args []string, t *testing.T, handler http.HandlerFunc, clientConfig *tls.Config) *serverTester {
-	return newServerTesterInternal(args, t, handler, true, clientConfig)
+	return newServerTesterInternal(args, t, []http.HandlerFunc{handler}, loopbackIPv4, true, clientConfig)
 }
 
-// newServerTesterInternal creates test context.  If frontendTLS is
-// true, set up TLS frontend connection.
-func newServerTesterInternal(args []string, t *testing.T, handler http.HandlerFunc, frontendTLS bool, clientConfig *tls.Config) *serverTester {
-	ts := httptest.NewUnstartedServer(handler)
+// newServerTesterTLSMutual creates test context for TLS frontend
+// connection, which presents client certificate loaded from certFile
+// and keyFile.
+func newServerTesterTLSMutual(args []string, t *testing.T, handler http.HandlerFunc, certFile, keyFile string) *serverTester {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading client certificate: %v", err)
+	}
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	return newServerTesterInternal(args, t, []http.HandlerFunc{handler}, loopbackIPv4, true, clientConfig)
+}
+
+// newServerTesterConfig creates test context for plain TCP frontend
+// connection, and starts nghttpx with configuration file which
+// contains confLines.  The file is removed by Close.
+func newServerTesterConfig(confLines []string, t *testing.T, handler http.HandlerFunc) *serverTester {
+	f, err := ioutil.TempFile("", "nghttpx-conf")
+	if err != nil {
+		t.Fatalf("Error creating configuration file: %v", err)
+	}
+	confPath := f.Name()
+	_, err = io.WriteString(f, strings.Join(confLines, "\n")+"\n")
+	f.Close()
+	if err != nil {
+		os.Remove(confPath)
+		t.Fatalf("Error writing configuration file: %v", err)
+	}
+
+	var st *serverTester
+	// newServerTesterInternal calls t.Fatalf on error, which still
+	// runs deferred calls.
+	defer func() {
+		if st == nil {
+			os.Remove(confPath)
+		}
+	}()
+	st = newServerTesterInternal([]string{"--conf=" + confPath}, t, []http.HandlerFunc{handler}, loopbackIPv4, false, nil)
+	st.confPath = confPath
+	return st
+}
+
+// newServerTesterBackends creates test context for plain TCP
+// frontend connection, and a backend server per handler in handlers.
+// The backend servers are given to nghttpx in the order of handlers.
+func newServerTesterBackends(args []string, t *testing.T, handlers []http.HandlerFunc) *serverTester {
+	return newServerTesterInternal(args, t, handlers, loopbackIPv4, false, nil)
+}
+
+// newServerTesterIPv6 creates test context for plain TCP frontend
+// connection, whose frontend and backend servers listen on IPv6
+// loopback address.  The test is skipped if IPv6 is not available.
+func newServerTesterIPv6(args []string, t *testing.T, handler http.HandlerFunc) *serverTester {
+	ln, err := net.Listen("tcp", net.JoinHostPort(loopbackIPv6, "0"))
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	ln.Close()
+	return newServerTesterInternal(args, t, []http.HandlerFunc{handler}, loopbackIPv6, false, nil)
+}
+
+// newServerTesterInternal creates test context.  Frontend and backend
+// servers listen on host, which is loopbackIPv4 or loopbackIPv6.  If
+// frontendTLS is true, set up TLS frontend connection.
+func newServerTesterInternal(args []string, t *testing.T, handlers []http.HandlerFunc, host string, frontendTLS bool, clientConfig *tls.Config) *serverTester {
+	backendReqs := &backendRecorder{
+		reqs:   make(map[string]*backendRequest),
+		counts: make([]int, len(handlers)),
+	}
 
 	backendTLS := false
 	for _, k := range args {
@@ -87,17 +207,49 @@ func newServerTesterInternal(args []string, t *testing.T, handler http.HandlerFu
 		}
 	}
 	if backendTLS {
-		nghttp2.ConfigureServer(ts.Config, &nghttp2.Server{})
-		// According to httptest/server.go, we have to set
-		// NextProtos separately for ts.TLS.  NextProtos set
-		// in nghttp2.ConfigureServer is effectively ignored.
-		ts.TLS = new(tls.Config)
-		ts.TLS.NextProtos = append(ts.TLS.NextProtos, "h2-14")
-		ts.StartTLS()
 		args = append(args, "-k")
-	} else {
-		ts.Start()
 	}
+
+	var backends []*httptest.Server
+	for i, handler := range handlers {
+		ts := httptest.NewUnstartedServer(backendReqs.wrap(i, handler))
+		if host != loopbackIPv4 {
+			// httptest.Server listens on 127.0.0.1 by
+			// default.
+			ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				t.Fatalf("Error listening on %v: %v", host, err)
+			}
+			ts.Listener.Close()
+			ts.Listener = ln
+		}
+		if backendTLS {
+			nghttp2.ConfigureServer(ts.Config, &nghttp2.Server{})
+			// According to httptest/server.go, we have to set
+			// NextProtos separately for ts.TLS.  NextProtos set
+			// in nghttp2.ConfigureServer is effectively ignored.
+			ts.TLS = new(tls.Config)
+			ts.TLS.NextProtos = append(ts.TLS.NextProtos, "h2-14")
+			ts.StartTLS()
+		} else {
+			ts.Start()
+		}
+		backends = append(backends, ts)
+
+		backendURL, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatalf("Error parsing URL from httptest.Server: %v", err)
+		}
+
+		// URL.Host looks like "127.0.0.1:8080" or "[::1]:8080",
+		// but we want "127.0.0.1,8080" or "::1,8080"
+		backendHost, backendPort, err := net.SplitHostPort(backendURL.Host)
+		if err != nil {
+			t.Fatalf("Error parsing backend address %v: %v", backendURL.Host, err)
+		}
+		args = append(args, fmt.Sprintf("-b%v,%v", backendHost, backendPort))
+	}
+
 	scheme := "http"
 	if frontendTLS {
 		scheme = "https"
@@ -106,29 +258,49 @@ func newServerTesterInternal(args []string, t *testing.T, handler http.HandlerFu
 		args = append(args, "--frontend-no-tls")
 	}
 
-	backendURL, err := url.Parse(ts.URL)
+	accessLog, err := ioutil.TempFile("", "nghttpx-access-log")
+	if err != nil {
+		t.Fatalf("Error creating access log file: %v", err)
+	}
+	accessLog.Close()
+
+	port, err := unusedPort(host)
 	if err != nil {
-		t.Fatalf("Error parsing URL from httptest.Server: %v", err)
+		t.Fatalf("Error allocating frontend port: %v", err)
 	}
 
-	// URL.Host looks like "127.0.0.1:8080", but we want
-	// "127.0.0.1,8080"
-	b := "-b" + strings.Replace(backendURL.Host, ":", ",", -1)
-	args = append(args, fmt.Sprintf("-f127.0.0.1,%v", serverPort), b,
-		"--errorlog-file="+testDir+"/log.txt", "-LINFO")
+	args = append(args, fmt.Sprintf("-f%v,%v", host, port),
+		"--errorlog-file="+errorLogPath, "-LINFO",
+		"--accesslog-file="+accessLog.Name())
 
-	authority := fmt.Sprintf("127.0.0.1:%v", serverPort)
+	authority := net.JoinHostPort(host, strconv.Itoa(port))
 
 	st := &serverTester{
-		cmd:          exec.Command(serverBin, args...),
-		t:            t,
-		ts:           ts,
-		url:          fmt.Sprintf("%v://%v", scheme, authority),
-		nextStreamID: 1,
-		authority:    authority,
-		frCh:         make(chan http2.Frame),
-		spdyFrCh:     make(chan spdy.Frame),
-		errCh:        make(chan error),
+		cmd:           exec.Command(serverBin, args...),
+		accessLogPath: accessLog.Name(),
+		t:             t,
+		ts:            backends[0],
+		backends:      backends,
+		backendReqs:   backendReqs,
+		url:           fmt.Sprintf("%v://%v", scheme, authority),
+		authority:     authority,
+	}
+	if frontendTLS {
+		if clientConfig == nil {
+			st.tlsConfig = new(tls.Config)
+		} else {
+			st.tlsConfig = clientConfig
+		}
+		st.tlsConfig.InsecureSkipVerify = true
+		if len(st.tlsConfig.NextProtos) == 0 {
+			st.tlsConfig.NextProtos = []string{"h2-14", "spdy/3.1"}
+		}
+	}
+
+	// error log is appended, so skip the part written by the
+	// previous tests.
+	if fi, err := os.Stat(errorLogPath); err == nil {
+		st.errorLogOffset = fi.Size()
 	}
 
 	if err := st.cmd.Start(); err != nil {
@@ -137,21 +309,7 @@ func newServerTesterInternal(args []string, t *testing.T, handler http.HandlerFu
 
 	retry := 0
 	for {
-		var conn net.Conn
-		var err error
-		if frontendTLS {
-			var tlsConfig *tls.Config
-			if clientConfig == nil {
-				tlsConfig = new(tls.Config)
-			} else {
-				tlsConfig = clientConfig
-			}
-			tlsConfig.InsecureSkipVerify = true
-			tlsConfig.NextProtos = []string{"h2-14", "spdy/3.1"}
-			conn, err = tls.Dial("tcp", authority, tlsConfig)
-		} else {
-			conn, err = net.Dial("tcp", authority)
-		}
+		conn, err := net.Dial("tcp", authority)
 		if err != nil {
 			retry += 1
 			if retry >= 100 {
@@ -161,145 +319,1036 @@ func newServerTesterInternal(args []string, t *testing.T, handler http.HandlerFu
 			time.Sleep(150 * time.Millisecond)
 			continue
 		}
-		if frontendTLS {
-			tlsConn := conn.(*tls.Conn)
-			cs := tlsConn.ConnectionState()
-			if !cs.NegotiatedProtocolIsMutual {
-				st.Close()
-				st.t.Fatalf("Error negotiated next protocol is not mutual")
-			}
+		// server is listening at this point, so handshake
+		// failure is not worth retrying.
+		conn, err = st.handshake(conn)
+		if err != nil {
+			st.Close()
+			st.t.Fatalf("Error %v", err)
 		}
-		st.conn = conn
+		st.setConn(conn)
 		break
 	}
 
+	return st
+}
+
+// unusedPort returns TCP port on host which is not in use, so
+// that each serverTester has its own frontend port.  The port is
+// released before it returns, and another process may take it until
+// nghttpx binds it, but such a race is rare in practice.
+func unusedPort(host string) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// backendRequest is the request received by backend server.
+type backendRequest struct {
+	backend    int // index of backend server which received the request
+	method     string
+	proto      string
+	requestURI string // request target as it appeared in the request line
+	url        *url.URL
+	host       string
+	header     http.Header
+	body       []byte
+}
+
+// headerValues returns all values of header field name in the order
+// of reception.  name is case-insensitive.
+func (br *backendRequest) headerValues(name string) []string {
+	return br.header[http.CanonicalHeaderKey(name)]
+}
+
+// backendRecorder records the requests received by backend server.
+// It is safe to use from concurrent handlers.
+type backendRecorder struct {
+	mu     sync.Mutex
+	reqs   map[string]*backendRequest // keyed by Test-Case header field
+	last   *backendRequest
+	counts []int // number of requests received by each backend server
+}
+
+// wrap returns handler of the backend-th backend server which
+// records the request, and calls handler.
+// The request is recorded before handler is called, so that it is
+// recorded even if handler fails.  The request body is recorded as
+// handler reads it, and the rest of the body is not read; use
+// readBodyHandler to record whole body.
+func (rec *backendRecorder) wrap(backend int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := *r.URL
+		br := &backendRequest{
+			backend:    backend,
+			method:     r.Method,
+			proto:      r.Proto,
+			requestURI: r.RequestURI,
+			url:        &u,
+			host:       r.Host,
+			header:     cloneHeader(r.Header),
+		}
+		var body bytes.Buffer
+		r.Body = ioutil.NopCloser(io.TeeReader(r.Body, &body))
+
+		rec.mu.Lock()
+		rec.reqs[br.header.Get("Test-Case")] = br
+		rec.last = br
+		rec.mu.Unlock()
+
+		defer func() {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			br.body = body.Bytes()
+			rec.counts[backend]++
+		}()
+
+		handler(w, r)
+	}
+}
+
+// backendRequestCounts returns the number of requests which each
+// backend server finished handling so far, in the order of
+// st.backends.
+func (st *serverTester) backendRequestCounts() []int {
+	st.backendReqs.mu.Lock()
+	defer st.backendReqs.mu.Unlock()
+	counts := make([]int, len(st.backendReqs.counts))
+	copy(counts, st.backendReqs.counts)
+	return counts
+}
+
+// lastBackendRequest returns the request which backend server
+// received most recently, or nil if there is none.
+func (st *serverTester) lastBackendRequest() *backendRequest {
+	st.backendReqs.mu.Lock()
+	defer st.backendReqs.mu.Unlock()
+	return st.backendReqs.last
+}
+
+// backendRequest returns the request received by backend server
+// whose Test-Case header field is name, or nil if there is none.
+func (st *serverTester) backendRequest(name string) *backendRequest {
+	st.backendReqs.mu.Lock()
+	defer st.backendReqs.mu.Unlock()
+	return st.backendReqs.reqs[name]
+}
+
+// assertForwardedFor reports error through st.t if X-Forwarded-For
+// header field of the request which backend server received most
+// recently does not contain wantContains.  If wantContains is empty,
+// it reports error if the header field is present.
+func (st *serverTester) assertForwardedFor(wantContains string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	xff, found := req.header["X-Forwarded-For"]
+	if wantContains == "" {
+		if found {
+			st.t.Errorf("X-Forwarded-For = %v; want nothing", xff)
+		}
+		return
+	}
+	if got := strings.Join(xff, ", "); !strings.Contains(got, wantContains) {
+		st.t.Errorf("X-Forwarded-For = %q; want containing %q", got, wantContains)
+	}
+}
+
+// assertBackendProto reports error through st.t if the most recent
+// request received by backend server was not in protocol want, such
+// as "HTTP/1.1".
+func (st *serverTester) assertBackendProto(want string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	if got := req.proto; got != want {
+		st.t.Errorf("backend protocol: %v; want %v", got, want)
+	}
+}
+
+// assertBackendRequestURI reports error through st.t if the request
+// target of the most recent request received by backend server is
+// not want.  Unlike url, the request target is not decoded, and shows
+// exactly what server forwarded.
+func (st *serverTester) assertBackendRequestURI(want string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	if got := req.requestURI; got != want {
+		st.t.Errorf("backend request target: %v; want %v", got, want)
+	}
+}
+
+// assertBackendHost reports error through st.t if Host header field
+// of the most recent request received by backend server is not want.
+func (st *serverTester) assertBackendHost(want string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	if got := req.host; got != want {
+		st.t.Errorf("backend request host: %v; want %v", got, want)
+	}
+}
+
+// assertBackendHeader reports error through st.t if the most recent
+// request received by backend server does not have header field name
+// whose value is want.  Multiple values are joined with ", ".
+func (st *serverTester) assertBackendHeader(name, want string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	vs := req.headerValues(name)
+	if len(vs) == 0 {
+		st.t.Errorf("backend request %v: missing; want %q", name, want)
+		return
+	}
+	if got := strings.Join(vs, ", "); got != want {
+		st.t.Errorf("backend request %v: %q; want %q", name, got, want)
+	}
+}
+
+// assertNoBackendHeader reports error through st.t if the most
+// recent request received by backend server has header field name,
+// even if its value is empty.
+func (st *serverTester) assertNoBackendHeader(name string) {
+	req := st.lastBackendRequest()
+	if req == nil {
+		st.t.Errorf("backend did not receive request")
+		return
+	}
+	if vs, ok := req.header[http.CanonicalHeaderKey(name)]; ok {
+		st.t.Errorf("backend request %v: %q; want nothing", name, vs)
+	}
+}
+
+// assertNoResponseHeader reports error through st.t if res has header
+// field name, even if its value is empty.
+func (st *serverTester) assertNoResponseHeader(res *serverResponse, name string) {
+	if vs, ok := res.header[http.CanonicalHeaderKey(name)]; ok {
+		st.t.Errorf("%v: %q; want nothing", name, vs)
+	}
+}
+
+// assertVia reports error through st.t if Via header field of the
+// request which backend server received most recently is not
+// wantRequest, or that of res is not wantResponse.  Empty want means
+// that the header field must not be present.
+func (st *serverTester) assertVia(res *serverResponse, wantRequest, wantResponse string) {
+	if req := st.lastBackendRequest(); req == nil {
+		st.t.Errorf("backend did not receive request")
+	} else if got := strings.Join(req.header["Via"], ", "); got != wantRequest {
+		st.t.Errorf("request Via: %q; want %q", got, wantRequest)
+	}
+	if got := strings.Join(res.header[http.CanonicalHeaderKey("via")], ", "); got != wantResponse {
+		st.t.Errorf("response Via: %q; want %q", got, wantResponse)
+	}
+}
+
+// handshake performs TLS handshake over conn if frontend is TLS, and
+// returns the TLS connection.  Otherwise conn is returned as is.
+func (st *serverTester) handshake(conn net.Conn) (net.Conn, error) {
+	if st.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, st.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	cs := tlsConn.ConnectionState()
+	if !cs.NegotiatedProtocolIsMutual {
+		tlsConn.Close()
+		return nil, errors.New("negotiated next protocol is not mutual")
+	}
+	st.negotiatedProto = cs.NegotiatedProtocol
+	return tlsConn, nil
+}
+
+// setConn makes conn the connection to frontend server, and resets
+// all per-connection state.
+func (st *serverTester) setConn(conn net.Conn) {
+	st.conn = conn
+	st.br = nil
+	st.h1Closed = false
+	st.h2PrefaceSent = false
+	st.nextStreamID = 1
+	st.nextSpdyPingID = 1
+	st.connDataReceived = 0
+	st.connRecvWindow = initialWindowSize
+	st.settingsAckPending = 0
+	st.serverSettings = make(map[http2.SettingID]uint32)
+	st.spdyServerSettings = make(map[spdy.SettingsId]uint32)
+	st.handles = make(map[uint32]*streamHandle)
+	st.hblk = pendingHeaderBlock{}
+	if st.connDone != nil {
+		close(st.connDone)
+	}
+	st.connDone = make(chan struct{})
+	st.readerProto = ""
+	st.frReqCh = make(chan struct{})
+	st.frPending = false
+	st.frErr = nil
+	st.frCh = make(chan http2.Frame)
+	st.spdyFrCh = make(chan spdy.Frame)
+	st.errCh = make(chan error)
+
 	st.fr = http2.NewFramer(st.conn, st.conn)
+	// we want to send invalid frames, such as self dependency, as
+	// they are to test server.
+	st.fr.AllowIllegalWrites = true
 	spdyFr, err := spdy.NewFramer(st.conn, st.conn)
 	if err != nil {
 		st.Close()
 		st.t.Fatalf("Error spdy.NewFramer: %v", err)
 	}
 	st.spdyFr = spdyFr
+	st.headerBlkBuf.Reset()
 	st.enc = hpack.NewEncoder(&st.headerBlkBuf)
 	st.dec = hpack.NewDecoder(4096, func(f hpack.HeaderField) {
 		st.header.Add(f.Name, f.Value)
+		st.headerFields = append(st.headerFields, f)
 	})
+}
 
-	return st
+// reconnect closes the connection to frontend server, and opens new
+// one.  The TLS configuration is reused, so that the TLS session is
+// resumed if its ClientSessionCache is set.  If it fails, st.conn is
+// nil, and requests fail with errNoConn until reconnect succeeds.
+func (st *serverTester) reconnect() error {
+	if st.conn != nil {
+		st.conn.Close()
+		st.conn = nil
+	}
+	if st.connDone != nil {
+		close(st.connDone)
+		st.connDone = nil
+	}
+	conn, err := net.Dial("tcp", st.authority)
+	if err != nil {
+		return err
+	}
+	hsConn, err := st.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	st.setConn(hsConn)
+	return nil
+}
+
+// errNoConn is returned if there is no connection to frontend server
+// because reconnect failed.
+var errNoConn = errors.New("no connection to frontend server")
+
+// withRetry calls do, which sends a request and reads its response,
+// for example by st.http2 or st.http1, up to attempts times while it
+// fails with transient error, and returns the result of the last
+// call.  The connection is reopened before each retry, because its
+// state is unknown after the failure; failing to reopen it because
+// connection is refused also counts as an attempt.  Each retry is
+// logged.  do is called again as it is, so the retried request is
+// sent with the same Test-Case header field.  Therefore the request
+// must be idempotent, and backend server may receive it more than
+// once, in which case st.backendRequest returns the last one and
+// st.backendRequestCounts counts all of them.  It is opt-in for the
+// test which is flaky on slow machines; it should not be used where
+// the error is what the test checks.
+func (st *serverTester) withRetry(attempts int, do func() (*serverResponse, error)) (*serverResponse, error) {
+	var (
+		res *serverResponse
+		err error
+	)
+	for i := 1; i <= attempts; i++ {
+		if i > 1 {
+			st.t.Logf("attempt %v/%v failed: %v; retrying", i-1, attempts, err)
+			if err = st.reconnect(); err != nil {
+				res = nil
+				if isTransientError(err) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		res, err = do()
+		if err == nil || !isTransientError(err) {
+			return res, err
+		}
+	}
+	return res, err
+}
+
+// isTransientError returns true if err may go away by retrying the
+// request on new connection: timeout waiting for frame, connection
+// closed by server, and connection refused by st.reconnect.
+func isTransientError(err error) bool {
+	switch err {
+	case errReadTimeout, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	return isConnRefused(err)
+}
+
+// isConnRefused returns true if err is the error of net.Dial because
+// connection is refused.
+func isConnRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	switch e := opErr.Err.(type) {
+	case *os.SyscallError:
+		return e.Err == syscall.ECONNREFUSED
+	case syscall.Errno:
+		return e == syscall.ECONNREFUSED
+	}
+	return false
 }
 
 func (st *serverTester) Close() {
 	if st.conn != nil {
 		st.conn.Close()
 	}
+	if st.connDone != nil {
+		close(st.connDone)
+		st.connDone = nil
+	}
 	if st.cmd != nil {
 		st.cmd.Process.Kill()
 		st.cmd.Wait()
 	}
-	if st.ts != nil {
-		st.ts.Close()
+	for _, ts := range st.backends {
+		ts.Close()
+	}
+	if st.confPath != "" {
+		os.Remove(st.confPath)
+	}
+	if st.accessLogPath != "" {
+		os.Remove(st.accessLogPath)
+	}
+}
+
+// readAccessLog returns the lines written in access log so far.
+// Server writes a line after the response is sent, so this waits for
+// the log to become non-empty and then stop growing, up to 2 seconds.
+func (st *serverTester) readAccessLog() ([]string, error) {
+	var prev []byte
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, err := ioutil.ReadFile(st.accessLogPath)
+		if err != nil {
+			return nil, err
+		}
+		if (len(b) > 0 && bytes.Equal(b, prev)) || time.Now().After(deadline) {
+			s := strings.TrimSuffix(string(b), "\n")
+			if s == "" {
+				return nil, nil
+			}
+			return strings.Split(s, "\n"), nil
+		}
+		prev = b
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// errorLogContains returns true if error log written by this test's
+// server contains substr.  Since server may not have written the log
+// yet, this keeps reading the log up to 2 seconds until substr is
+// found.
+func (st *serverTester) errorLogContains(substr string) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, err := ioutil.ReadFile(errorLogPath)
+		if err == nil && int64(len(b)) > st.errorLogOffset &&
+			bytes.Contains(b[st.errorLogOffset:], []byte(substr)) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// errReadTimeout is returned when no frame is read within the read
+// timeout.
+var errReadTimeout = errors.New("timeout waiting for frame")
+
+// maxStreamID is the largest HTTP/2 stream ID.
+const maxStreamID = 1<<31 - 1
+
+// initialWindowSize is the initial flow control window size of HTTP/2.
+const initialWindowSize = 65535
+
+var errH1Closed = errors.New("HTTP/1 connection was closed by previous response")
+
+// http2ReadTimeout returns the timeout to read HTTP/2 frames, which
+// is st.readTimeout if it is not zero, or 5 seconds.
+func (st *serverTester) http2ReadTimeout() time.Duration {
+	if st.readTimeout != 0 {
+		return st.readTimeout
+	}
+	return 5 * time.Second
+}
+
+// spdyReadTimeout returns the timeout to read a SPDY frame, which is
+// st.readTimeout if it is not zero, or 2 seconds.
+func (st *serverTester) spdyReadTimeout() time.Duration {
+	if st.readTimeout != 0 {
+		return st.readTimeout
 	}
+	return 2 * time.Second
 }
 
 func (st *serverTester) readFrame() (http2.Frame, error) {
-	go func() {
-		f, err := st.fr.ReadFrame()
+	return st.readFrameTimeout(time.After(st.http2ReadTimeout()))
+}
+
+// readFrames reads HTTP/2 frames until until returns true for the
+// frame just read, and returns all frames read so far.  The timeout
+// applies to the whole sequence, not to each frame.  The
+// framer invalidates the payload of a frame when the next frame is
+// read, so until should inspect payload while it is called; only
+// FrameHeader is reliable for the returned frames other than the last
+// one.
+func (st *serverTester) readFrames(until func(http2.Frame) bool) ([]http2.Frame, error) {
+	var frames []http2.Frame
+	timeout := time.After(st.http2ReadTimeout())
+	for {
+		f, err := st.readFrameTimeout(timeout)
 		if err != nil {
-			st.errCh <- err
-			return
+			return frames, err
 		}
-		st.frCh <- f
-	}()
+		frames = append(frames, f)
+		if until(f) {
+			return frames, nil
+		}
+	}
+}
+
+// expectNoFrame returns nil if no HTTP/2 frame is received within d.
+// Otherwise it returns error describing the received frame, or the
+// error occurred while reading.
+func (st *serverTester) expectNoFrame(d time.Duration) error {
+	f, err := st.readFrameTimeout(time.After(d))
+	if err == errReadTimeout {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpected frame %v on stream %v", f.Header().Type, f.Header().StreamID)
+}
+
+// readFrameTimeout reads a HTTP/2 frame.  It returns error if timeout
+// fires before a frame is read.
+func (st *serverTester) readFrameTimeout(timeout <-chan time.Time) (http2.Frame, error) {
+	if err := st.requestFrame(readerHTTP2); err != nil {
+		return nil, err
+	}
 
 	select {
 	case f := <-st.frCh:
+		st.frPending = false
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			st.connDataReceived += int(f.Length)
+			st.connRecvWindow -= int(f.Length)
+		case *http2.SettingsFrame:
+			if f.IsAck() && st.settingsAckPending > 0 {
+				st.settingsAckPending--
+			}
+		}
 		return f, nil
 	case err := <-st.errCh:
+		st.frPending = false
+		st.frErr = err
 		return nil, err
-	case <-time.After(5 * time.Second):
-		return nil, errors.New("timeout waiting for frame")
+	case <-timeout:
+		return nil, errReadTimeout
 	}
 }
 
 func (st *serverTester) readSpdyFrame() (spdy.Frame, error) {
-	go func() {
-		f, err := st.spdyFr.ReadFrame()
-		if err != nil {
-			st.errCh <- err
-			return
-		}
-		st.spdyFrCh <- f
-	}()
+	return st.readSpdyFrameTimeout(time.After(st.spdyReadTimeout()))
+}
+
+// readSpdyFrameTimeout reads a SPDY frame.  It returns error if
+// timeout fires before a frame is read.
+func (st *serverTester) readSpdyFrameTimeout(timeout <-chan time.Time) (spdy.Frame, error) {
+	if err := st.requestFrame(readerSPDY); err != nil {
+		return nil, err
+	}
 
 	select {
 	case f := <-st.spdyFrCh:
+		st.frPending = false
 		return f, nil
 	case err := <-st.errCh:
+		st.frPending = false
+		st.frErr = err
 		return nil, err
-	case <-time.After(2 * time.Second):
-		return nil, errors.New("timeout waiting for frame")
+	case <-timeout:
+		return nil, errReadTimeout
+	}
+}
+
+const (
+	readerHTTP2 = "HTTP/2"
+	readerSPDY  = "SPDY"
+)
+
+// requestFrame asks the frame reader goroutine to read next frame of
+// proto, starting it if it has not been started for the connection.
+// If the previous read timed out, its request is still outstanding,
+// and the frame read for it is delivered to the caller.  The
+// protocol of the connection is fixed by the first read, and reading
+// the other protocol afterwards is an error.
+func (st *serverTester) requestFrame(proto string) error {
+	if st.frErr != nil {
+		return st.frErr
+	}
+	if st.readerProto == "" {
+		st.startFrameReader(proto)
+	} else if st.readerProto != proto {
+		return fmt.Errorf("reading %v frame from %v connection", proto, st.readerProto)
 	}
+	if !st.frPending {
+		st.frReqCh <- struct{}{}
+		st.frPending = true
+	}
+	return nil
+}
+
+// startFrameReader starts the goroutine which reads frames of proto
+// from st.conn.  It is started lazily, because the connection may be
+// used for HTTP/1, or carry HTTP/1 upgrade response before HTTP/2
+// frames.  The goroutine reads a frame only when it is requested
+// through st.frReqCh, because the framer invalidates the payload of
+// the previous frame.  It exits when the connection is closed or
+// replaced.
+func (st *serverTester) startFrameReader(proto string) {
+	st.readerProto = proto
+	fr, spdyFr := st.fr, st.spdyFr
+	reqCh, frCh, spdyFrCh, errCh, done := st.frReqCh, st.frCh, st.spdyFrCh, st.errCh, st.connDone
+	go func() {
+		for {
+			select {
+			case <-reqCh:
+			case <-done:
+				return
+			}
+			var err error
+			switch proto {
+			case readerHTTP2:
+				var f http2.Frame
+				if f, err = fr.ReadFrame(); err == nil {
+					select {
+					case frCh <- f:
+						continue
+					case <-done:
+						return
+					}
+				}
+			case readerSPDY:
+				var f spdy.Frame
+				if f, err = spdyFr.ReadFrame(); err == nil {
+					select {
+					case spdyFrCh <- f:
+						continue
+					case <-done:
+						return
+					}
+				}
+			}
+			select {
+			case errCh <- err:
+			case <-done:
+			}
+			return
+		}
+	}()
 }
 
 type requestParam struct {
-	name      string              // name for this request to identify the request in log easily
-	streamID  uint32              // stream ID, automatically assigned if 0
-	method    string              // method, defaults to GET
-	scheme    string              // scheme, defaults to http
-	authority string              // authority, defaults to backend server address
-	path      string              // path, defaults to /
-	header    []hpack.HeaderField // additional request header fields
-	body      []byte              // request body
+	name              string               // name for this request to identify the request in log easily
+	streamID          uint32               // stream ID, automatically assigned if 0; even or used ID can be given to test server, and it does not affect automatic assignment
+	method            string               // method, defaults to GET
+	scheme            string               // scheme, defaults to http
+	authority         string               // authority, which is sent as Host header field in HTTP/1, defaults to backend server address
+	path              string               // path, defaults to /
+	header            []hpack.HeaderField  // additional request header fields, whose names are sent as is without lowercasing in HTTP/2
+	body              []byte               // request body
+	padLen            int                  // length of padding of HTTP/2 DATA frame carrying request body, which is sent even if body is empty if not 0
+	emptyData         int                  // number of empty HTTP/2 DATA frames sent after request body, the last of which carries END_STREAM instead of HEADERS or body
+	chunked           bool                 // send request body in chunked transfer-encoding in HTTP/1
+	chunkSize         int                  // maximum chunk size of chunked request body, whole body is sent in 1 chunk if 0
+	priority          *http2.PriorityParam // priority included in HTTP/2 HEADERS, if not nil and not zero
+	headerPadLen      uint8                // length of padding of HTTP/2 HEADERS
+	forceContinuation bool                 // split HTTP/2 request header block into HEADERS and CONTINUATION even if it fits in 1 frame
+	protocol          string               // :protocol sent by connect for extended CONNECT
+	rawPseudoHeaders  []hpack.HeaderField  // HTTP/2 pseudo header fields sent as is instead of the ones generated from method, scheme, authority and path, if not nil
+	rawRequestLine    string               // HTTP/1 request line sent as is without CRLF instead of the one generated from method and path, if not empty
+	httpMajor         int                  // major version in HTTP/1 request line, which is 1.1 if httpMajor is 0
+	httpMinor         int                  // minor version in HTTP/1 request line
+	contentLength     string               // Content-Length sent regardless of the length of body, if not empty; otherwise it is derived from body in HTTP/1, and not sent in HTTP/2
+	noHost            bool                 // do not send Host header field in HTTP/1, which HTTP/1.0 allows; authority is ignored
 }
 
-func (st *serverTester) http1(rp requestParam) (*serverResponse, error) {
-	method := "GET"
-	if rp.method != "" {
-		method = rp.method
+// tlsConnectionState returns the state of TLS frontend connection.
+// It returns false if the connection is not TLS.
+func (st *serverTester) tlsConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := st.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
 	}
+	return tlsConn.ConnectionState(), true
+}
 
-	var body io.Reader
-	if rp.body != nil {
-		body = bytes.NewBuffer(rp.body)
+// ocspStaple returns OCSP response stapled by server in TLS
+// handshake.  It returns nil if no response is stapled, or the
+// connection is not TLS.
+func (st *serverTester) ocspStaple() []byte {
+	cs, ok := st.tlsConnectionState()
+	if !ok {
+		return nil
 	}
-	req, err := http.NewRequest(method, st.url, body)
-	if err != nil {
-		return nil, err
+	return cs.OCSPResponse
+}
+
+// http1 sends HTTP/1.1 request rp over st.conn, which is TLS
+// connection if frontend is TLS, and reads the response.
+// rp.rawRequestLine, rp.httpMajor, rp.contentLength and rp.noHost,
+// which make the request be written by hand, cannot be combined with rp.chunked
+// or Expect: 100-continue, and neither can the latter two with each
+// other; it is an error to request such combination.
+func (st *serverTester) http1(rp requestParam) (*serverResponse, error) {
+	if st.conn == nil {
+		return nil, errNoConn
 	}
-	for _, h := range rp.header {
-		req.Header.Add(h.Name, h.Value)
+	if st.h1Closed {
+		return nil, errH1Closed
 	}
-	req.Header.Add("Test-Case", rp.name)
 
-	if err := req.Write(st.conn); err != nil {
-		return nil, err
+	raw := rp.rawRequestLine != "" || rp.httpMajor != 0 || rp.contentLength != "" || rp.noHost
+	expect := rp.body != nil && expectContinue(rp.header)
+	switch {
+	case raw && rp.chunked:
+		return nil, errors.New("rawRequestLine, httpMajor, contentLength and noHost cannot be combined with chunked")
+	case raw && expect:
+		return nil, errors.New("rawRequestLine, httpMajor, contentLength and noHost cannot be combined with Expect: 100-continue")
+	case rp.chunked && expect:
+		return nil, errors.New("chunked cannot be combined with Expect: 100-continue")
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(st.conn), req)
+
+	req, err := st.http1Request(rp)
 	if err != nil {
 		return nil, err
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
+
+	res := &serverResponse{}
+	br := st.http1Reader()
+
+	var resp *http.Response
+	if rp.rawRequestLine != "" {
+		resp, err = st.http1RawRequestLine(req, rp.rawRequestLine, rp.body, br)
+	} else if raw {
+		// http.Request.Write always writes HTTP/1.1, Host, and
+		// Content-Length which agrees with body.
+		major, minor := 1, 1
+		if rp.httpMajor != 0 {
+			major, minor = rp.httpMajor, rp.httpMinor
+		}
+		requestLine := fmt.Sprintf("%v %v HTTP/%v.%v", req.Method, req.URL.RequestURI(), major, minor)
+		resp, err = st.http1RawRequestLine(req, requestLine, rp.body, br)
+	} else if rp.chunked {
+		resp, err = st.http1Chunked(req, rp.body, rp.chunkSize, br)
+	} else if expect {
+		resp, err = st.http1ExpectContinue(req, rp.body, br, res)
+	} else {
+		if err := req.Write(st.conn); err != nil {
+			return nil, err
+		}
+		resp, err = http.ReadResponse(br, req)
+	}
 	if err != nil {
 		return nil, err
 	}
-	resp.Body.Close()
-
-	res := &serverResponse{
-		status:    resp.StatusCode,
-		header:    resp.Header,
-		body:      respBody,
-		connClose: resp.Close,
+	if err := st.readHTTP1Response(resp, res); err != nil {
+		return nil, err
 	}
 
 	return res, nil
 }
 
-func (st *serverTester) spdy(rp requestParam) (*serverResponse, error) {
-	res := &serverResponse{}
+// http1RawRequestLine writes req with requestLine in place of the
+// request line generated by http.Request.Write, and reads the
+// response.  This is used to send request target in absolute-form
+// or asterisk-form, HTTP version other than 1.1, or Content-Length
+// which disagrees with body.  Host is taken from req.Host, and
+// Content-Length is derived from body, unless req.Header has them.
+// Host is not sent if req.Host is empty.
+func (st *serverTester) http1RawRequestLine(req *http.Request, requestLine string, body []byte, br *bufio.Reader) (*http.Response, error) {
+	// the response to HEAD request has no body
+	req.Method = strings.SplitN(requestLine, " ", 2)[0]
 
-	var id spdy.StreamId
-	if rp.streamID != 0 {
-		id = spdy.StreamId(rp.streamID)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v\r\n", requestLine)
+	if _, ok := req.Header["Host"]; !ok && req.Host != "" {
+		fmt.Fprintf(&buf, "Host: %v\r\n", req.Host)
+	}
+	if _, ok := req.Header["Content-Length"]; !ok && body != nil {
+		fmt.Fprintf(&buf, "Content-Length: %v\r\n", len(body))
+	}
+	if err := req.Header.Write(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	if _, err := st.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(br, req)
+}
+
+// http1Pipeline writes HTTP/1.1 requests rps back-to-back over
+// st.conn before reading any response, and then reads the responses
+// in order.  The i-th response is for rps[i].  Chunked request body,
+// Expect: 100-continue and rp.noHost are not supported, and it is an
+// error to request them.
+func (st *serverTester) http1Pipeline(rps []requestParam) ([]*serverResponse, error) {
+	if st.conn == nil {
+		return nil, errNoConn
+	}
+	if st.h1Closed {
+		return nil, errH1Closed
+	}
+
+	reqs := make([]*http.Request, len(rps))
+	for i, rp := range rps {
+		if rp.chunked || rp.noHost || (rp.body != nil && expectContinue(rp.header)) {
+			return nil, errors.New("chunked, noHost and Expect: 100-continue are not supported in pipeline")
+		}
+		req, err := st.http1Request(rp)
+		if err != nil {
+			return nil, err
+		}
+		reqs[i] = req
+	}
+
+	var buf bytes.Buffer
+	for _, req := range reqs {
+		if err := req.Write(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := st.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	br := st.http1Reader()
+	var ress []*serverResponse
+	for i, req := range reqs {
+		if st.h1Closed {
+			return ress, fmt.Errorf("connection closed after response %v of %v", i, len(reqs))
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return ress, err
+		}
+		res := &serverResponse{}
+		if err := st.readHTTP1Response(resp, res); err != nil {
+			return ress, err
+		}
+		ress = append(ress, res)
+	}
+
+	return ress, nil
+}
+
+// http1Request creates HTTP/1.1 request from rp.
+func (st *serverTester) http1Request(rp requestParam) (*http.Request, error) {
+	method := "GET"
+	if rp.method != "" {
+		method = rp.method
+	}
+
+	var body io.Reader
+	if rp.body != nil {
+		body = bytes.NewBuffer(rp.body)
+	}
+	reqURL := st.url
+	if rp.path != "" {
+		reqURL += rp.path
+	}
+
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if rp.noHost {
+		req.Host = ""
+	} else if rp.authority != "" {
+		req.Host = rp.authority
+	}
+	for _, h := range rp.header {
+		req.Header.Add(h.Name, h.Value)
+	}
+	if rp.contentLength != "" {
+		req.Header.Set("Content-Length", rp.contentLength)
+	}
+	req.Header.Add("Test-Case", rp.name)
+
+	return req, nil
+}
+
+// readHTTP1Response reads body of resp, and fills res with it.
+func (st *serverTester) readHTTP1Response(resp *http.Response, res *serverResponse) error {
+	res.recordByteTime()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	res.recordByteTime()
+
+	res.status = resp.StatusCode
+	res.header = resp.Header
+	res.body = respBody
+	// resp.Trailer is filled after body is read completely
+	res.trailer = resp.Trailer
+	res.connClose = resp.Close
+	if resp.Close {
+		st.h1Closed = true
+	}
+
+	return nil
+}
+
+// http1Reader returns buffered reader of st.conn shared by HTTP/1
+// requests, so that data read ahead is not lost between responses.
+func (st *serverTester) http1Reader() *bufio.Reader {
+	if st.br == nil {
+		st.br = bufio.NewReader(st.conn)
+	}
+	return st.br
+}
+
+// writeHTTP1Header writes request line, Host and header fields in
+// req.Header to st.conn.  Unlike req.Write, Content-Length and
+// Transfer-Encoding are written as they are in req.Header, and no
+// body is written.
+func (st *serverTester) writeHTTP1Header(req *http.Request) error {
+	var hd bytes.Buffer
+	fmt.Fprintf(&hd, "%v %v HTTP/1.1\r\nHost: %v\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	if err := req.Header.Write(&hd); err != nil {
+		return err
+	}
+	hd.WriteString("\r\n")
+	_, err := st.conn.Write(hd.Bytes())
+	return err
+}
+
+// http1Chunked writes req with body in chunked transfer-encoding.
+// Each chunk has at most chunkSize bytes.  If chunkSize is 0, whole
+// body is sent in 1 chunk.
+func (st *serverTester) http1Chunked(req *http.Request, body []byte, chunkSize int, br *bufio.Reader) (*http.Response, error) {
+	req.Header.Set("Transfer-Encoding", "chunked")
+	if err := st.writeHTTP1Header(req); err != nil {
+		return nil, err
+	}
+
+	if chunkSize == 0 {
+		chunkSize = len(body)
+	}
+	var buf bytes.Buffer
+	for len(body) > 0 {
+		n := chunkSize
+		if n > len(body) {
+			n = len(body)
+		}
+		fmt.Fprintf(&buf, "%x\r\n%s\r\n", n, body[:n])
+		body = body[n:]
+	}
+	buf.WriteString("0\r\n\r\n")
+	if _, err := st.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(br, req)
+}
+
+// expectContinue returns true if header contains Expect:
+// 100-continue.
+func expectContinue(header []hpack.HeaderField) bool {
+	for _, h := range header {
+		if strings.ToLower(h.Name) == "expect" && strings.ToLower(h.Value) == "100-continue" {
+			return true
+		}
+	}
+	return false
+}
+
+// http1ExpectContinue writes request header of req first, and waits
+// for 100 response.  After receiving 100 response, or after 1 second
+// without any response, it writes body and returns the final
+// response.  If server sends final response without 100 response,
+// body is not written, and the connection is regarded as closed,
+// because server may read the announced body as the next request.
+func (st *serverTester) http1ExpectContinue(req *http.Request, body []byte, br *bufio.Reader, res *serverResponse) (*http.Response, error) {
+	// req.Write buffers request header until body is written, so
+	// we have to write request header by hand.
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	if err := st.writeHTTP1Header(req); err != nil {
+		return nil, err
+	}
+
+	st.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := br.Peek(1)
+	st.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusContinue {
+			st.h1Closed = true
+			return resp, nil
+		}
+		res.interimStatus = resp.StatusCode
+	} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		return nil, err
+	}
+
+	if _, err := st.conn.Write(body); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, req)
+}
+
+func (st *serverTester) spdy(rp requestParam) (*serverResponse, error) {
+	if st.conn == nil {
+		return nil, errNoConn
+	}
+	res := &serverResponse{}
+
+	var id spdy.StreamId
+	if rp.streamID != 0 {
+		id = spdy.StreamId(rp.streamID)
 		if id >= spdy.StreamId(st.nextStreamID) && id%2 == 1 {
 			st.nextStreamID = uint32(id) + 2
 		}
@@ -363,6 +1412,10 @@ func (st *serverTester) spdy(rp requestParam) (*serverResponse, error) {
 		}
 	}
 
+	// streams contains the request stream and streams pushed by
+	// server for it, which are not closed yet.
+	streams := map[spdy.StreamId]*serverResponse{id: res}
+
 loop:
 	for {
 		fr, err := st.readSpdyFrame()
@@ -370,66 +1423,171 @@ loop:
 			return res, err
 		}
 		switch f := fr.(type) {
+		case *spdy.SynStreamFrame:
+			// server push is unidirectional stream associated
+			// to the request stream.
+			if f.AssociatedToStreamId != id || f.CFHeader.Flags&spdy.ControlFlagUnidirectional == 0 {
+				break
+			}
+			push := &serverResponse{
+				streamID:  uint32(f.StreamId),
+				reqHeader: cloneHeader(f.Headers),
+			}
+			res.pushResponses = append(res.pushResponses, push)
+			if f.CFHeader.Flags&spdy.ControlFlagFin != 0 {
+				break
+			}
+			streams[f.StreamId] = push
 		case *spdy.SynReplyFrame:
-			if f.StreamId != id {
+			sr, ok := streams[f.StreamId]
+			if !ok {
 				break
 			}
-			res.header = cloneHeader(f.Headers)
-			if _, err := fmt.Sscan(res.header.Get(":status"), &res.status); err != nil {
+			sr.recordByteTime()
+			sr.header = cloneHeader(f.Headers)
+			if _, err := fmt.Sscan(sr.header.Get(":status"), &sr.status); err != nil {
 				return res, fmt.Errorf("Error parsing status code: %v", err)
 			}
 			if f.CFHeader.Flags&spdy.ControlFlagFin != 0 {
-				break loop
+				delete(streams, f.StreamId)
+				if len(streams) == 0 {
+					break loop
+				}
+			}
+		case *spdy.HeadersFrame:
+			// pushed stream carries response header in HEADERS
+			sr, ok := streams[f.StreamId]
+			if !ok || f.StreamId == id {
+				break
+			}
+			sr.recordByteTime()
+			sr.header = cloneHeader(f.Headers)
+			if _, err := fmt.Sscan(sr.header.Get(":status"), &sr.status); err != nil {
+				return res, fmt.Errorf("Error parsing status code: %v", err)
+			}
+			if f.CFHeader.Flags&spdy.ControlFlagFin != 0 {
+				delete(streams, f.StreamId)
+				if len(streams) == 0 {
+					break loop
+				}
 			}
 		case *spdy.DataFrame:
-			if f.StreamId != id {
+			sr, ok := streams[f.StreamId]
+			if !ok {
 				break
 			}
-			res.body = append(res.body, f.Data...)
+			sr.recordByteTime()
+			sr.body = append(sr.body, f.Data...)
 			if f.Flags&spdy.DataFlagFin != 0 {
-				break loop
+				delete(streams, f.StreamId)
+				if len(streams) == 0 {
+					break loop
+				}
 			}
 		case *spdy.RstStreamFrame:
-			if f.StreamId != id {
+			sr, ok := streams[f.StreamId]
+			if !ok {
 				break
 			}
-			res.spdyRstErrCode = f.Status
-			break loop
+			sr.spdyRstErrCode = f.Status
+			delete(streams, f.StreamId)
+			if len(streams) == 0 {
+				break loop
+			}
 		case *spdy.GoAwayFrame:
 			if f.Status == spdy.GoAwayOK {
 				break
 			}
 			res.spdyGoAwayErrCode = f.Status
 			break loop
+		case *spdy.SettingsFrame:
+			st.recordSpdyServerSettings(f)
 		}
 	}
 	return res, nil
 }
 
 func (st *serverTester) http2(rp requestParam) (*serverResponse, error) {
+	res, err := st.writeHTTP2Request(rp, true)
+	if err != nil {
+		return nil, err
+	}
+	return st.readHTTP2Response(res)
+}
+
+// http2Concurrent sends all requests in rps first, and then reads
+// the responses in a single read loop.  The responses are returned in
+// the same order of rps.
+func (st *serverTester) http2Concurrent(rps []requestParam) ([]*serverResponse, error) {
+	var ress []*serverResponse
+	for _, rp := range rps {
+		res, err := st.writeHTTP2Request(rp, true)
+		if err != nil {
+			return nil, err
+		}
+		ress = append(ress, res)
+	}
+	return ress, st.readHTTP2Responses(ress)
+}
+
+// writeHTTP2Request sends HTTP/2 request rp, and returns
+// serverResponse which has stream ID assigned to the request.  If
+// endStream is false, END_STREAM is not set, and the request body can
+// be sent later.
+func (st *serverTester) writeHTTP2Request(rp requestParam, endStream bool) (*serverResponse, error) {
 	res := &serverResponse{}
 	st.headerBlkBuf.Reset()
-	st.header = make(http.Header)
 
-	var id uint32
-	if rp.streamID != 0 {
-		id = rp.streamID
-		if id >= st.nextStreamID && id%2 == 1 {
-			st.nextStreamID = id + 2
+	id := st.http2StreamID(rp)
+	res.streamID = id
+
+	if err := st.sendPreface(); err != nil {
+		return nil, err
+	}
+
+	if rp.rawPseudoHeaders != nil {
+		for _, h := range rp.rawPseudoHeaders {
+			_ = st.enc.WriteField(h)
 		}
 	} else {
-		id = st.nextStreamID
-		st.nextStreamID += 2
+		st.writePseudoHeaders(rp)
+	}
+
+	_ = st.enc.WriteField(pair("test-case", rp.name))
+
+	for _, h := range rp.header {
+		_ = st.enc.WriteField(h)
+	}
+	if rp.contentLength != "" {
+		_ = st.enc.WriteField(pair("content-length", rp.contentLength))
+	}
+
+	// DATA is sent for padding even if rp.body is empty
+	sendData := len(rp.body) != 0 || rp.padLen != 0
+
+	if err := st.writeHeaderBlock(id, endStream && !sendData && rp.emptyData == 0, rp.priority, rp.headerPadLen, rp.forceContinuation); err != nil {
+		return nil, err
+	}
+
+	if sendData {
+		// TODO we assume rp.body fits in 1 frame
+		if err := st.writeDataPadded(id, endStream && rp.emptyData == 0, rp.body, rp.padLen); err != nil {
+			return nil, err
+		}
 	}
 
-	if !st.h2PrefaceSent {
-		st.h2PrefaceSent = true
-		fmt.Fprint(st.conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
-		if err := st.fr.WriteSettings(); err != nil {
+	for i := 0; i < rp.emptyData; i++ {
+		if err := st.fr.WriteData(id, endStream && i == rp.emptyData-1, nil); err != nil {
 			return nil, err
 		}
 	}
 
+	return res, nil
+}
+
+// writePseudoHeaders encodes request pseudo header fields generated
+// from rp into st.headerBlkBuf.
+func (st *serverTester) writePseudoHeaders(rp requestParam) {
 	method := "GET"
 	if rp.method != "" {
 		method = rp.method
@@ -453,6 +1611,63 @@ func (st *serverTester) http2(rp requestParam) (*serverResponse, error) {
 		path = rp.path
 	}
 	_ = st.enc.WriteField(pair(":path", path))
+}
+
+// http2StreamID returns rp.streamID if it is not 0, or the next
+// stream ID, and updates st.nextStreamID.  st.nextStreamID is not
+// changed by rp.streamID which is even or not larger than the stream
+// IDs used so far.
+func (st *serverTester) http2StreamID(rp requestParam) uint32 {
+	if rp.streamID == 0 {
+		id := st.nextStreamID
+		st.nextStreamID += 2
+		return id
+	}
+	id := rp.streamID
+	if id >= st.nextStreamID && id%2 == 1 {
+		st.nextStreamID = id + 2
+	}
+	return id
+}
+
+// connect sends HTTP/2 CONNECT request rp without END_STREAM, and
+// returns streamHandle for the tunnel.  If rp.protocol is not empty,
+// it is sent in :protocol with :scheme and :path as extended CONNECT.
+// rp.body is not sent.
+func (st *serverTester) connect(rp requestParam) (*streamHandle, error) {
+	if err := st.sendPreface(); err != nil {
+		return nil, err
+	}
+
+	res := &serverResponse{}
+	st.headerBlkBuf.Reset()
+
+	id := st.http2StreamID(rp)
+	res.streamID = id
+
+	_ = st.enc.WriteField(pair(":method", "CONNECT"))
+
+	authority := st.authority
+	if rp.authority != "" {
+		authority = rp.authority
+	}
+	_ = st.enc.WriteField(pair(":authority", authority))
+
+	if rp.protocol != "" {
+		_ = st.enc.WriteField(pair(":protocol", rp.protocol))
+
+		scheme := "http"
+		if rp.scheme != "" {
+			scheme = rp.scheme
+		}
+		_ = st.enc.WriteField(pair(":scheme", scheme))
+
+		path := "/"
+		if rp.path != "" {
+			path = rp.path
+		}
+		_ = st.enc.WriteField(pair(":path", path))
+	}
 
 	_ = st.enc.WriteField(pair("test-case", rp.name))
 
@@ -460,97 +1675,1319 @@ func (st *serverTester) http2(rp requestParam) (*serverResponse, error) {
 		_ = st.enc.WriteField(h)
 	}
 
-	err := st.fr.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      id,
-		EndStream:     len(rp.body) == 0,
-		EndHeaders:    true,
-		BlockFragment: st.headerBlkBuf.Bytes(),
-	})
-	if err != nil {
+	if err := st.writeHeaderBlock(id, false, rp.priority, rp.headerPadLen, rp.forceContinuation); err != nil {
 		return nil, err
 	}
 
-	if len(rp.body) != 0 {
-		// TODO we assume rp.body fits in 1 frame
-		if err := st.fr.WriteData(id, true, rp.body); err != nil {
-			return nil, err
-		}
+	return st.registerStream(res), nil
+}
+
+// writeDataPadded sends DATA frame containing data to the stream id
+// with padLen bytes of padding.  If padLen is 0, PADDED flag is not
+// set.  http2.Framer has no API to write padded DATA, so the frame is
+// built by hand.
+func (st *serverTester) writeDataPadded(id uint32, endStream bool, data []byte, padLen int) error {
+	if padLen == 0 {
+		return st.fr.WriteData(id, endStream, data)
+	}
+	if padLen > 255 {
+		return fmt.Errorf("padLen %v is too large", padLen)
+	}
+	flags := http2.FlagDataPadded
+	if endStream {
+		flags |= http2.FlagDataEndStream
 	}
+	payload := make([]byte, 1+len(data)+padLen)
+	payload[0] = byte(padLen)
+	copy(payload[1:], data)
+	return st.fr.WriteRawFrame(http2.FrameData, flags, id, payload)
+}
 
-loop:
-	for {
-		fr, err := st.readFrame()
-		if err != nil {
-			return res, err
+// rapidReset opens n streams with GET request named name, and resets
+// each of them with CANCEL right after its HEADERS.  All frames are
+// written at once to reach server as fast as possible.  It returns
+// the stream IDs used.
+func (st *serverTester) rapidReset(name string, n int) ([]uint32, error) {
+	if err := st.sendPreface(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fr := http2.NewFramer(&buf, nil)
+	ids := make([]uint32, n)
+	for i := range ids {
+		rp := requestParam{name: name}
+		id := st.http2StreamID(rp)
+		ids[i] = id
+
+		st.headerBlkBuf.Reset()
+		st.writePseudoHeaders(rp)
+		_ = st.enc.WriteField(pair("test-case", rp.name))
+
+		if err := fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      id,
+			EndStream:     true,
+			EndHeaders:    true,
+			BlockFragment: st.headerBlkBuf.Bytes(),
+		}); err != nil {
+			return nil, err
 		}
-		switch f := fr.(type) {
-		case *http2.HeadersFrame:
-			_, err := st.dec.Write(f.HeaderBlockFragment())
-			if err != nil {
-				return res, err
-			}
-			if f.FrameHeader.StreamID != id {
-				st.header = make(http.Header)
-				break
-			}
-			res.header = cloneHeader(st.header)
-			var status int
-			status, err = strconv.Atoi(res.header.Get(":status"))
-			if err != nil {
-				return res, fmt.Errorf("Error parsing status code: %v", err)
-			}
-			res.status = status
-			if f.StreamEnded() {
-				break loop
-			}
-		case *http2.DataFrame:
-			if f.FrameHeader.StreamID != id {
-				break
-			}
-			res.body = append(res.body, f.Data()...)
-			if f.StreamEnded() {
-				break loop
-			}
-		case *http2.RSTStreamFrame:
-			if f.FrameHeader.StreamID != id {
-				break
-			}
-			res.errCode = f.ErrCode
-			break loop
-		case *http2.GoAwayFrame:
-			if f.ErrCode == http2.ErrCodeNo {
-				break
-			}
-			res.errCode = f.ErrCode
-			res.connErr = true
-			break loop
-		case *http2.SettingsFrame:
-			if f.IsAck() {
-				break
-			}
-			if err := st.fr.WriteSettingsAck(); err != nil {
-				return res, err
-			}
-			// TODO handle PUSH_PROMISE as well, since it alters HPACK context
+		if err := fr.WriteRSTStream(id, http2.ErrCodeCancel); err != nil {
+			return nil, err
 		}
 	}
-	return res, nil
+
+	if _, err := st.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return ids, nil
 }
 
-type serverResponse struct {
-	status            int                  // HTTP status code
-	header            http.Header          // response header fields
-	body              []byte               // response body
-	errCode           http2.ErrCode        // error code received in HTTP/2 RST_STREAM or GOAWAY
-	connErr           bool                 // true if HTTP/2 connection error
-	spdyGoAwayErrCode spdy.GoAwayStatus    // status code received in SPDY RST_STREAM
-	spdyRstErrCode    spdy.RstStreamStatus // status code received in SPDY GOAWAY
-	connClose         bool                 // Conection: close is included in response header in HTTP/1 test
+// writeDataOnStream sends HTTP/2 preface if it has not been sent, and
+// DATA frame containing data to the stream id regardless of its state.
+// This is used to test how server handles DATA on the stream in idle,
+// half-closed (remote) or closed state.  RFC 7540 requires connection
+// error PROTOCOL_ERROR for idle stream, and stream error
+// STREAM_CLOSED for half-closed (remote) or closed stream, although
+// DATA on the stream closed recently may be ignored.
+func (st *serverTester) writeDataOnStream(id uint32, data []byte, endStream bool) error {
+	if err := st.sendPreface(); err != nil {
+		return err
+	}
+	return st.fr.WriteData(id, endStream, data)
 }
 
-func cloneHeader(h http.Header) http.Header {
-	h2 := make(http.Header, len(h))
-	for k, vv := range h {
+// writeHeadersRaw sends HEADERS frame to the stream id, which
+// carries block as header block fragment as it is.  Unlike
+// writeHeaderBlock, st.enc is not involved, so block can be the one
+// which hpack.Encoder never produces, such as the one with invalid
+// index or specific representations, and the encoder's dynamic table
+// is not affected.  If block adds entries to the dynamic table of
+// server, st.enc is out of sync after that.  If endHeaders is false,
+// the rest of block must be sent in CONTINUATION by st.fr.
+func (st *serverTester) writeHeadersRaw(id uint32, block []byte, endStream, endHeaders bool) error {
+	if err := st.sendPreface(); err != nil {
+		return err
+	}
+	return st.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      id,
+		BlockFragment: block,
+		EndStream:     endStream,
+		EndHeaders:    endHeaders,
+	})
+}
+
+// hpackLiteral returns HPACK literal header field representation of
+// name and value, which are not Huffman encoded.  prefix is the first
+// byte of the representation: 0x00 for literal without indexing, 0x10
+// for never indexed, and 0x40 for incremental indexing.  name and
+// value must be shorter than 127 bytes.
+func hpackLiteral(prefix byte, name, value string) []byte {
+	b := []byte{prefix, byte(len(name))}
+	b = append(b, name...)
+	b = append(b, byte(len(value)))
+	return append(b, value...)
+}
+
+// writeHeaderBlock sends the header block encoded in st.headerBlkBuf
+// to the stream id in HEADERS, followed by CONTINUATION if it does
+// not fit in 1 frame.  If priority is not nil, it is included in
+// HEADERS.  HEADERS is padded with padLen bytes if padLen is not 0.
+func (st *serverTester) writeHeaderBlock(id uint32, endStream bool, priority *http2.PriorityParam, padLen uint8, forceContinuation bool) error {
+	hp := http2.HeadersFrameParam{
+		StreamID:  id,
+		EndStream: endStream,
+		PadLength: padLen,
+	}
+	// first is the room for header block in HEADERS
+	first := maxFrameSize
+	if priority != nil {
+		hp.Priority = *priority
+		if !priority.IsZero() {
+			first -= 5
+		}
+	}
+	if padLen != 0 {
+		first -= 1 + int(padLen)
+	}
+	frags := splitHeaderBlock(st.headerBlkBuf.Bytes(), first, forceContinuation)
+	hp.EndHeaders = len(frags) == 1
+	hp.BlockFragment = frags[0]
+	if err := st.fr.WriteHeaders(hp); err != nil {
+		return err
+	}
+	for i, frag := range frags[1:] {
+		if err := st.fr.WriteContinuation(id, i == len(frags)-2, frag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitHeaderBlock splits header block blk into fragments so that
+// the first one is at most first bytes, which is the room in HEADERS,
+// and each of the rest fits in CONTINUATION of default
+// SETTINGS_MAX_FRAME_SIZE.  If force is true, blk is split into at
+// least 2 fragments if it has more than 1 byte, so that CONTINUATION
+// is used anyway.
+func splitHeaderBlock(blk []byte, first int, force bool) [][]byte {
+	n := first
+	if force && len(blk) > 1 && len(blk) <= n {
+		n = (len(blk) + 1) / 2
+	}
+	if len(blk) <= n {
+		return [][]byte{blk}
+	}
+	frags := [][]byte{blk[:n]}
+	blk = blk[n:]
+	for len(blk) > maxFrameSize {
+		frags = append(frags, blk[:maxFrameSize])
+		blk = blk[maxFrameSize:]
+	}
+	return append(frags, blk)
+}
+
+// readHTTP2Response reads HTTP/2 frames until the stream
+// res.streamID and the streams pushed for it are closed, and fills
+// res with the received response.
+func (st *serverTester) readHTTP2Response(res *serverResponse) (*serverResponse, error) {
+	return res, st.readHTTP2Responses([]*serverResponse{res})
+}
+
+// readHTTP2Responses reads HTTP/2 frames until all streams in ress
+// and the streams pushed for them are closed.  Frames are dispatched
+// to the responses by stream ID.  If connection error happens, it is
+// recorded in all responses whose stream is not closed yet.
+func (st *serverTester) readHTTP2Responses(ress []*serverResponse) error {
+	st.header = make(http.Header)
+	st.headerFields = nil
+
+	// reqs contains the request streams.
+	reqs := make(map[uint32]*serverResponse)
+	// streams contains the request streams and streams promised
+	// by server, which are not closed yet.
+	streams := make(map[uint32]*serverResponse)
+	for _, res := range ress {
+		reqs[res.streamID] = res
+		streams[res.streamID] = res
+	}
+	// cancelled contains the promised streams reset by client
+	// because st.cancelPush is true.
+	cancelled := make(map[uint32]*serverResponse)
+
+	var (
+		// blkHd is the frame header of HEADERS or PUSH_PROMISE
+		// whose header block is being received.
+		blkHd     http2.FrameHeader
+		promiseID uint32
+		// blk is the header block, which may span several
+		// CONTINUATION frames.
+		blk      []byte
+		blkEnded bool
+	)
+
+	// headerBlock decodes the complete header block blk, and
+	// applies it to the stream blkHd.StreamID.  It returns true if
+	// all streams are closed.
+	headerBlock := func() (bool, error) {
+		if _, err := st.dec.Write(blk); err != nil {
+			return false, err
+		}
+		header, fields := st.header, st.headerFields
+		st.header = make(http.Header)
+		st.headerFields = nil
+
+		if blkHd.Type == http2.FramePushPromise {
+			res, ok := reqs[blkHd.StreamID]
+			if !ok {
+				return false, nil
+			}
+			push := &serverResponse{
+				streamID:  promiseID,
+				reqHeader: header,
+			}
+			res.pushResponses = append(res.pushResponses, push)
+			if st.cancelPush {
+				push.errCode = http2.ErrCodeCancel
+				cancelled[promiseID] = push
+				return false, st.writeRSTStream(promiseID, http2.ErrCodeCancel)
+			}
+			streams[promiseID] = push
+			return false, nil
+		}
+
+		sr, ok := streams[blkHd.StreamID]
+		if !ok {
+			return false, nil
+		}
+		if st.strictHeader && sr.headerError == nil {
+			sr.headerError = checkHeaderFields(fields, sr.header != nil)
+		}
+		if sr.header != nil {
+			// header block after response header is trailer
+			sr.trailer = header
+		} else {
+			status, err := strconv.Atoi(header.Get(":status"))
+			if err != nil {
+				return false, fmt.Errorf("Error parsing status code: %v", err)
+			}
+			if isInterimStatus(status) && blkHd.Flags&http2.FlagHeadersEndStream == 0 {
+				// interim response; final one follows
+				sr.interimResponses = append(sr.interimResponses, &serverResponse{
+					status:       status,
+					header:       header,
+					headerFields: fields,
+				})
+				return false, nil
+			}
+			sr.header = header
+			sr.headerFields = fields
+			sr.status = status
+			sr.headersEndStream = blkHd.Flags&http2.FlagHeadersEndStream != 0
+		}
+		if blkHd.Flags&http2.FlagHeadersEndStream == 0 {
+			return false, nil
+		}
+		delete(streams, blkHd.StreamID)
+		return len(streams) == 0, nil
+	}
+
+loop:
+	for {
+		fr, err := st.readFrame()
+		if err != nil {
+			return err
+		}
+		if sr, ok := streams[fr.Header().StreamID]; ok {
+			sr.recordByteTime()
+		}
+		switch f := fr.(type) {
+		case *http2.HeadersFrame:
+			blkHd = f.FrameHeader
+			blk = append(blk[:0], f.HeaderBlockFragment()...)
+			blkEnded = f.HeadersEnded()
+		case *http2.PushPromiseFrame:
+			// promised header block must be decoded to keep HPACK
+			// context in sync, even if we are not interested in it.
+			blkHd = f.FrameHeader
+			promiseID = f.PromiseID
+			blk = append(blk[:0], f.HeaderBlockFragment()...)
+			blkEnded = f.HeadersEnded()
+		case *http2.ContinuationFrame:
+			blk = append(blk, f.HeaderBlockFragment()...)
+			blkEnded = f.HeadersEnded()
+		case *http2.DataFrame:
+			if err := st.autoWindowUpdate(f); err != nil {
+				return err
+			}
+			sr, ok := streams[f.FrameHeader.StreamID]
+			if !ok {
+				// record DATA which server sent after
+				// cancellation, if any.
+				if sr, ok := cancelled[f.FrameHeader.StreamID]; ok {
+					sr.body = append(sr.body, f.Data()...)
+				}
+				break
+			}
+			sr.recordDataTime(f)
+			sr.body = append(sr.body, f.Data()...)
+			if f.StreamEnded() {
+				delete(streams, f.FrameHeader.StreamID)
+				if len(streams) == 0 {
+					break loop
+				}
+			}
+		case *http2.RSTStreamFrame:
+			sr, ok := streams[f.FrameHeader.StreamID]
+			if !ok {
+				break
+			}
+			sr.errCode = f.ErrCode
+			sr.reset = true
+			delete(streams, f.FrameHeader.StreamID)
+			if len(streams) == 0 {
+				break loop
+			}
+		case *http2.GoAwayFrame:
+			if f.ErrCode == http2.ErrCodeNo {
+				break
+			}
+			debug := make([]byte, len(f.DebugData()))
+			copy(debug, f.DebugData())
+			for _, sr := range streams {
+				sr.errCode = f.ErrCode
+				sr.connErr = true
+				sr.goAwayLastStreamID = f.LastStreamID
+				sr.goAwayDebugData = debug
+			}
+			break loop
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				break
+			}
+			st.recordServerSettings(f)
+			if err := st.fr.WriteSettingsAck(); err != nil {
+				return err
+			}
+		}
+		if blkEnded {
+			blkEnded = false
+			done, err := headerBlock()
+			if err != nil {
+				return err
+			}
+			if done {
+				break loop
+			}
+		}
+	}
+	return nil
+}
+
+// streamHandle is a handle of HTTP/2 stream opened by http2Begin.
+// It is used to exchange frames on the stream interactively.  The
+// frames received for the stream are applied to res as they arrive.
+type streamHandle struct {
+	st     *serverTester
+	res    *serverResponse
+	frames []http2.Frame // frames received for the stream, but not returned by Recv yet
+	closed bool          // true if the stream is closed
+}
+
+// pendingHeaderBlock is a header block, which may span several
+// CONTINUATION frames, being received.
+type pendingHeaderBlock struct {
+	hd        http2.FrameHeader // frame header of HEADERS or PUSH_PROMISE
+	promiseID uint32            // promised stream ID if hd is PUSH_PROMISE
+	blk       []byte
+}
+
+// http2Begin sends HTTP/2 request header and rp.body without
+// END_STREAM, and returns streamHandle for the stream.  The remaining
+// request body must be sent by streamHandle.SendData.  Frames must be
+// read by streamHandle.Recv or streamHandle.Response while the
+// streams opened by http2Begin are open; using http2 in the meantime
+// loses frames for them.
+func (st *serverTester) http2Begin(rp requestParam) (*streamHandle, error) {
+	res, err := st.writeHTTP2Request(rp, false)
+	if err != nil {
+		return nil, err
+	}
+	return st.registerStream(res), nil
+}
+
+// http2Async sends HTTP/2 request rp, and returns streamHandle for
+// the stream without waiting for the response.  The response is
+// obtained by streamHandle.Response, which buffers frames for the
+// other streams opened by http2Begin, http2Async or watchStream, so
+// that the responses can be read in any order.
+func (st *serverTester) http2Async(rp requestParam) (*streamHandle, error) {
+	res, err := st.writeHTTP2Request(rp, true)
+	if err != nil {
+		return nil, err
+	}
+	return st.registerStream(res), nil
+}
+
+// watchStream returns streamHandle for the stream id opened without
+// the methods above, for example by writing HEADERS by hand, so that
+// frames for it are demultiplexed in the same way.
+func (st *serverTester) watchStream(id uint32) *streamHandle {
+	return st.registerStream(&serverResponse{streamID: id})
+}
+
+// registerStream returns streamHandle for the stream res.streamID,
+// which receives frames for the stream from now on.
+func (st *serverTester) registerStream(res *serverResponse) *streamHandle {
+	sh := &streamHandle{st: st, res: res}
+	st.handles[res.streamID] = sh
+	return sh
+}
+
+// SendHeaders sends header fields in header as they are, which is
+// useful to send trailer.  If endStream is true, END_STREAM is set.
+func (sh *streamHandle) SendHeaders(header []hpack.HeaderField, endStream bool) error {
+	st := sh.st
+	st.headerBlkBuf.Reset()
+	for _, h := range header {
+		_ = st.enc.WriteField(h)
+	}
+	return st.writeHeaderBlock(sh.res.streamID, endStream, nil, 0, false)
+}
+
+// SendData sends DATA frame containing data to the stream.  If
+// endStream is true, END_STREAM is set.
+func (sh *streamHandle) SendData(data []byte, endStream bool) error {
+	return sh.st.fr.WriteData(sh.res.streamID, endStream, data)
+}
+
+// SendRST sends RST_STREAM with code to the stream, and closes the
+// stream.  Frames received for the stream after that are discarded.
+func (sh *streamHandle) SendRST(code http2.ErrCode) error {
+	sh.close()
+	return sh.st.writeRSTStream(sh.res.streamID, code)
+}
+
+// Recv returns the next frame received for the stream.  Frames for
+// the other streams opened by http2Begin are buffered so that their
+// Recv returns them later, and GOAWAY is delivered to all of them.
+// SETTINGS is acknowledged, and WINDOW_UPDATE is sent for DATA unless
+// st.manualWindowUpdate is true.  It returns io.EOF if the stream is
+// closed and no frame is left.
+func (sh *streamHandle) Recv() (http2.Frame, error) {
+	if len(sh.frames) > 0 {
+		f := sh.frames[0]
+		sh.frames = sh.frames[1:]
+		return f, nil
+	}
+	if sh.closed {
+		return nil, io.EOF
+	}
+
+	st := sh.st
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if err := st.dispatchFrame(f, sh); err != nil {
+			return nil, err
+		}
+		id := f.Header().StreamID
+		if id == sh.res.streamID || (id == 0 && f.Header().Type == http2.FrameGoAway) {
+			return f, nil
+		}
+	}
+}
+
+// http2RecvData returns the payload of the next DATA frame received
+// for the stream id opened by http2Begin, http2Async or watchStream,
+// and whether it ends the stream.  Once the stream is closed, it is
+// no longer found by id; use streamHandle.RecvData to drain the
+// frames buffered for it.
+func (st *serverTester) http2RecvData(id uint32) ([]byte, bool, error) {
+	sh, ok := st.handles[id]
+	if !ok {
+		return nil, false, fmt.Errorf("stream %v is not open", id)
+	}
+	return sh.RecvData()
+}
+
+// RecvData returns the payload of the next DATA frame received for
+// the stream, and whether it ends the stream.  The other frames for
+// the stream are applied to its response and skipped.  It returns
+// error if the stream is reset or closed before DATA is received.
+func (sh *streamHandle) RecvData() ([]byte, bool, error) {
+	for {
+		f, err := sh.Recv()
+		if err != nil {
+			return nil, false, err
+		}
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			data := make([]byte, len(f.Data()))
+			copy(data, f.Data())
+			return data, f.StreamEnded(), nil
+		case *http2.RSTStreamFrame:
+			return nil, false, fmt.Errorf("stream %v was reset with %v", sh.res.streamID, f.ErrCode)
+		case *http2.GoAwayFrame:
+			if f.ErrCode != http2.ErrCodeNo {
+				return nil, false, fmt.Errorf("connection was closed with %v", f.ErrCode)
+			}
+		}
+	}
+}
+
+// dispatchFrame buffers f for the stream handles other than sh which
+// it belongs to, and applies it.  GOAWAY belongs to all handles.  sh
+// may be nil.
+func (st *serverTester) dispatchFrame(f http2.Frame, sh *streamHandle) error {
+	id := f.Header().StreamID
+	var others []*streamHandle
+	if id == 0 {
+		if _, ok := f.(*http2.GoAwayFrame); ok {
+			for _, h := range st.handles {
+				if h != sh {
+					others = append(others, h)
+				}
+			}
+		}
+	} else if h, ok := st.handles[id]; ok && h != sh {
+		others = append(others, h)
+	}
+	if len(others) > 0 {
+		// the payload of f is invalidated by the next read, so
+		// buffered frames must be copied.
+		cf, err := cloneFrame(f)
+		if err != nil {
+			return err
+		}
+		for _, h := range others {
+			h.frames = append(h.frames, cf)
+		}
+	}
+	return st.applyFrame(f)
+}
+
+// waitGoAway reads HTTP/2 frames until GOAWAY for which until returns
+// true is received, and returns it.  The frames read meanwhile are
+// buffered for the stream handles which they belong to.
+func (st *serverTester) waitGoAway(until func(*http2.GoAwayFrame) bool) (*http2.GoAwayFrame, error) {
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if err := st.dispatchFrame(f, nil); err != nil {
+			return nil, err
+		}
+		if f, ok := f.(*http2.GoAwayFrame); ok && until(f) {
+			return f, nil
+		}
+	}
+}
+
+// http2UntilGoAway reads HTTP/2 frames until GOAWAY is received, and
+// returns the responses of the streams which had stream handles when
+// it was called, keyed by stream ID, and the GOAWAY.  If GOAWAY
+// carries error, the responses of the streams still open record it.
+// The returned GOAWAY is a copy, whose debug data stays valid.
+func (st *serverTester) http2UntilGoAway() (map[uint32]*serverResponse, *http2.GoAwayFrame, error) {
+	responses := make(map[uint32]*serverResponse)
+	for id, sh := range st.handles {
+		responses[id] = sh.res
+	}
+	f, err := st.waitGoAway(func(*http2.GoAwayFrame) bool {
+		return true
+	})
+	if err != nil {
+		return responses, nil, err
+	}
+	cf, err := cloneFrame(f)
+	if err != nil {
+		return responses, nil, err
+	}
+	return responses, cf.(*http2.GoAwayFrame), nil
+}
+
+// gracefulShutdown sends SIGQUIT to nghttpx to start graceful
+// shutdown, and waits for the shutdown notice, which is GOAWAY with
+// the maximum stream ID, so that the caller knows that server is in
+// graceful shutdown period.  The final GOAWAY, which carries the last
+// stream ID actually processed, follows after 2 seconds; wait for it
+// with waitGoAway.
+func (st *serverTester) gracefulShutdown() (*http2.GoAwayFrame, error) {
+	if err := st.cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+		return nil, err
+	}
+	return st.waitGoAway(func(f *http2.GoAwayFrame) bool {
+		return f.LastStreamID == maxStreamID
+	})
+}
+
+// Response calls Recv until the stream is closed, and returns the
+// response received.
+func (sh *streamHandle) Response() (*serverResponse, error) {
+	for !sh.closed {
+		if _, err := sh.Recv(); err != nil {
+			return nil, err
+		}
+	}
+	return sh.res, nil
+}
+
+func (sh *streamHandle) close() {
+	sh.closed = true
+	delete(sh.st.handles, sh.res.streamID)
+}
+
+// applyFrame updates the responses of the streams opened by
+// http2Begin with frame f.  Header blocks of all streams are decoded
+// here in the order of reception to keep HPACK context in sync.
+func (st *serverTester) applyFrame(f http2.Frame) error {
+	if sh, ok := st.handles[f.Header().StreamID]; ok {
+		sh.res.recordByteTime()
+	}
+	switch f := f.(type) {
+	case *http2.HeadersFrame:
+		st.hblk.hd = f.FrameHeader
+		st.hblk.blk = append(st.hblk.blk[:0], f.HeaderBlockFragment()...)
+		if f.HeadersEnded() {
+			return st.applyHeaderBlock()
+		}
+	case *http2.PushPromiseFrame:
+		st.hblk.hd = f.FrameHeader
+		st.hblk.promiseID = f.PromiseID
+		st.hblk.blk = append(st.hblk.blk[:0], f.HeaderBlockFragment()...)
+		if f.HeadersEnded() {
+			return st.applyHeaderBlock()
+		}
+	case *http2.ContinuationFrame:
+		st.hblk.blk = append(st.hblk.blk, f.HeaderBlockFragment()...)
+		if f.HeadersEnded() {
+			return st.applyHeaderBlock()
+		}
+	case *http2.DataFrame:
+		if err := st.autoWindowUpdate(f); err != nil {
+			return err
+		}
+		sh, ok := st.handles[f.FrameHeader.StreamID]
+		if !ok {
+			break
+		}
+		sh.res.recordDataTime(f)
+		sh.res.body = append(sh.res.body, f.Data()...)
+		if f.StreamEnded() {
+			sh.close()
+		}
+	case *http2.RSTStreamFrame:
+		sh, ok := st.handles[f.FrameHeader.StreamID]
+		if !ok {
+			break
+		}
+		sh.res.errCode = f.ErrCode
+		sh.res.reset = true
+		sh.close()
+	case *http2.GoAwayFrame:
+		if f.ErrCode == http2.ErrCodeNo {
+			break
+		}
+		debug := make([]byte, len(f.DebugData()))
+		copy(debug, f.DebugData())
+		for _, sh := range st.handles {
+			sh.res.errCode = f.ErrCode
+			sh.res.connErr = true
+			sh.res.goAwayLastStreamID = f.LastStreamID
+			sh.res.goAwayDebugData = debug
+			sh.close()
+		}
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			break
+		}
+		st.recordServerSettings(f)
+		return st.fr.WriteSettingsAck()
+	}
+	return nil
+}
+
+// applyHeaderBlock decodes the complete header block st.hblk, and
+// applies it to the stream if it is opened by http2Begin.
+func (st *serverTester) applyHeaderBlock() error {
+	st.header = make(http.Header)
+	st.headerFields = nil
+	if _, err := st.dec.Write(st.hblk.blk); err != nil {
+		return err
+	}
+	header, fields := st.header, st.headerFields
+
+	sh, ok := st.handles[st.hblk.hd.StreamID]
+	if !ok {
+		return nil
+	}
+	if st.hblk.hd.Type == http2.FramePushPromise {
+		sh.res.pushResponses = append(sh.res.pushResponses, &serverResponse{
+			streamID:  st.hblk.promiseID,
+			reqHeader: header,
+		})
+		return nil
+	}
+	if st.strictHeader && sh.res.headerError == nil {
+		sh.res.headerError = checkHeaderFields(fields, sh.res.header != nil)
+	}
+	if sh.res.header != nil {
+		// header block after response header is trailer
+		sh.res.trailer = header
+	} else {
+		status, err := strconv.Atoi(header.Get(":status"))
+		if err != nil {
+			return fmt.Errorf("Error parsing status code: %v", err)
+		}
+		if isInterimStatus(status) && st.hblk.hd.Flags&http2.FlagHeadersEndStream == 0 {
+			// interim response; final one follows
+			sh.res.interimResponses = append(sh.res.interimResponses, &serverResponse{
+				status:       status,
+				header:       header,
+				headerFields: fields,
+			})
+			return nil
+		}
+		sh.res.header = header
+		sh.res.headerFields = fields
+		sh.res.status = status
+		sh.res.headersEndStream = st.hblk.hd.Flags&http2.FlagHeadersEndStream != 0
+	}
+	if st.hblk.hd.Flags&http2.FlagHeadersEndStream != 0 {
+		sh.close()
+	}
+	return nil
+}
+
+// isInterimStatus returns true if status is 1xx other than 101,
+// which is followed by the final response.  101 is not allowed in
+// HTTP/2, and it is treated as the final response to detect it.
+func isInterimStatus(status int) bool {
+	return status/100 == 1 && status != http.StatusSwitchingProtocols
+}
+
+// checkHeaderFields returns error if fields decoded from response
+// header block are malformed: pseudo header field other than :status,
+// pseudo header field after regular one, or missing or duplicated
+// :status.  If trailer is true, no pseudo header field is allowed.
+func checkHeaderFields(fields []hpack.HeaderField, trailer bool) error {
+	regular := false
+	nstatus := 0
+	for _, f := range fields {
+		if !strings.HasPrefix(f.Name, ":") {
+			regular = true
+			continue
+		}
+		switch {
+		case trailer:
+			return fmt.Errorf("pseudo header field %v in trailer", f.Name)
+		case regular:
+			return fmt.Errorf("pseudo header field %v after regular header field", f.Name)
+		case f.Name != ":status":
+			return fmt.Errorf("unknown pseudo header field %v", f.Name)
+		}
+		nstatus++
+	}
+	if !trailer && nstatus != 1 {
+		return fmt.Errorf("%v :status header fields; want 1", nstatus)
+	}
+	return nil
+}
+
+// cloneFrame returns a copy of f whose payload is not invalidated by
+// the next st.fr.ReadFrame.  Padding is not preserved.
+func cloneFrame(f http2.Frame) (http2.Frame, error) {
+	var buf bytes.Buffer
+	fr := http2.NewFramer(&buf, &buf)
+	fr.AllowIllegalWrites = true
+
+	var err error
+	switch f := f.(type) {
+	case *http2.DataFrame:
+		err = fr.WriteData(f.StreamID, f.StreamEnded(), f.Data())
+	case *http2.HeadersFrame:
+		err = fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      f.StreamID,
+			BlockFragment: f.HeaderBlockFragment(),
+			EndStream:     f.StreamEnded(),
+			EndHeaders:    f.HeadersEnded(),
+			Priority:      f.Priority,
+		})
+	case *http2.PushPromiseFrame:
+		err = fr.WritePushPromise(http2.PushPromiseParam{
+			StreamID:      f.StreamID,
+			PromiseID:     f.PromiseID,
+			BlockFragment: f.HeaderBlockFragment(),
+			EndHeaders:    f.HeadersEnded(),
+		})
+	case *http2.ContinuationFrame:
+		err = fr.WriteContinuation(f.StreamID, f.HeadersEnded(), f.HeaderBlockFragment())
+	case *http2.GoAwayFrame:
+		err = fr.WriteGoAway(f.LastStreamID, f.ErrCode, f.DebugData())
+	default:
+		// other frames do not refer to the framer's buffer.
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fr.ReadFrame()
+}
+
+// http2Upgrade sends HTTP/1.1 request with HTTP/2 Upgrade header
+// fields.  After receiving 101 response, it sends HTTP/2 connection
+// preface and reads the response on stream 1.  The request must not
+// have body.
+func (st *serverTester) http2Upgrade(rp requestParam) (*serverResponse, error) {
+	method := "GET"
+	if rp.method != "" {
+		method = rp.method
+	}
+
+	req, err := http.NewRequest(method, st.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range rp.header {
+		req.Header.Add(h.Name, h.Value)
+	}
+	req.Header.Add("Test-Case", rp.name)
+
+	var settingsPayload []byte
+	for _, s := range st.prefaceSettings() {
+		settingsPayload = append(settingsPayload, byte(s.ID>>8), byte(s.ID),
+			byte(s.Val>>24), byte(s.Val>>16), byte(s.Val>>8), byte(s.Val))
+	}
+	req.Header.Add("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Add("Upgrade", h2cProtocol)
+	req.Header.Add("HTTP2-Settings", strings.TrimRight(base64.URLEncoding.EncodeToString(settingsPayload), "="))
+
+	if err := req.Write(st.conn); err != nil {
+		return nil, err
+	}
+
+	// We cannot use bufio.Reader here, since it may consume HTTP/2
+	// frames following 101 response.
+	var respHeader []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(respHeader, []byte("\r\n\r\n")) {
+		if _, err := st.conn.Read(b); err != nil {
+			return nil, err
+		}
+		respHeader = append(respHeader, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respHeader)), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("status: %v; want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// stream 1 is used by upgraded request
+	st.nextStreamID = 3
+
+	if err := st.writePreface(st.prefaceSettings()); err != nil {
+		return nil, err
+	}
+
+	return st.readHTTP2Response(&serverResponse{streamID: 1})
+}
+
+// sendPreface sends HTTP/2 connection preface with
+// st.prefaceSettings() if it has not been sent yet.  It returns
+// errNoConn if reconnect failed.
+func (st *serverTester) sendPreface() error {
+	if st.conn == nil {
+		return errNoConn
+	}
+	if st.h2PrefaceSent {
+		return nil
+	}
+	return st.writePreface(st.prefaceSettings())
+}
+
+// prefaceSettings returns the settings sent in HTTP/2 connection
+// preface, which are st.settings followed by SETTINGS_ENABLE_PUSH=0
+// if st.disablePush is true.
+func (st *serverTester) prefaceSettings() []http2.Setting {
+	if !st.disablePush {
+		return st.settings
+	}
+	settings := append([]http2.Setting(nil), st.settings...)
+	return append(settings, http2.Setting{ID: http2.SettingEnablePush, Val: 0})
+}
+
+// writePreface sends HTTP/2 connection preface and SETTINGS frame
+// containing settings.  Then it waits for SETTINGS frame from server
+// and acknowledges it.  The settings advertised by server are
+// recorded in st.serverSettings.
+func (st *serverTester) writePreface(settings []http2.Setting) error {
+	st.h2PrefaceSent = true
+	fmt.Fprint(st.conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	if err := st.fr.WriteSettings(settings...); err != nil {
+		return err
+	}
+	st.settingsAckPending++
+
+	timeout := time.After(st.http2ReadTimeout())
+	for {
+		fr, err := st.readFrameTimeout(timeout)
+		if err != nil {
+			return err
+		}
+		switch f := fr.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				break
+			}
+			st.recordServerSettings(f)
+			return st.fr.WriteSettingsAck()
+		case *http2.GoAwayFrame:
+			return fmt.Errorf("GOAWAY received before SETTINGS: %v", f.ErrCode)
+		}
+	}
+}
+
+// writeSettings sends SETTINGS frame containing settings after the
+// preface, and waits until server acknowledges it and all SETTINGS
+// sent before, so that settings are in effect when it returns.  The
+// frames read meanwhile are buffered for the stream handles which
+// they belong to.
+func (st *serverTester) writeSettings(settings ...http2.Setting) error {
+	if err := st.fr.WriteSettings(settings...); err != nil {
+		return err
+	}
+	st.settingsAckPending++
+
+	for st.settingsAckPending > 0 {
+		f, err := st.readFrame()
+		if err != nil {
+			return err
+		}
+		if err := st.dispatchFrame(f, nil); err != nil {
+			return err
+		}
+		if f, ok := f.(*http2.GoAwayFrame); ok {
+			return fmt.Errorf("GOAWAY received before SETTINGS ACK: %v", f.ErrCode)
+		}
+	}
+	return nil
+}
+
+// recordServerSettings stores settings in f to st.serverSettings.
+func (st *serverTester) recordServerSettings(f *http2.SettingsFrame) {
+	f.ForeachSetting(func(s http2.Setting) error {
+		st.serverSettings[s.ID] = s.Val
+		return nil
+	})
+}
+
+// serverSetting returns the value of SETTINGS parameter id last
+// advertised by server.  It returns false if server has not sent it.
+func (st *serverTester) serverSetting(id http2.SettingID) (uint32, bool) {
+	v, ok := st.serverSettings[id]
+	return v, ok
+}
+
+// setEncoderTableSize changes the maximum size of dynamic table of
+// HPACK encoder to n.  The dynamic table size update is emitted at
+// the beginning of the next header block.  n must not exceed
+// SETTINGS_HEADER_TABLE_SIZE advertised by server, which is 4096 if
+// server has not sent it, unless st.ignoreServerTableSize is true.
+// The latter is useful to test server's enforcement of the limit.
+// The encoder's own limit, which is 4096 by default, is set to n, so
+// that n is not silently clamped to it.
+func (st *serverTester) setEncoderTableSize(n uint32) error {
+	if !st.ignoreServerTableSize {
+		limit := uint32(defaultHeaderTableSize)
+		if v, ok := st.serverSetting(http2.SettingHeaderTableSize); ok {
+			limit = v
+		}
+		if n > limit {
+			return fmt.Errorf("table size %v exceeds SETTINGS_HEADER_TABLE_SIZE %v", n, limit)
+		}
+	}
+	st.enc.SetMaxDynamicTableSizeLimit(n)
+	st.enc.SetMaxDynamicTableSize(n)
+	return nil
+}
+
+// ping sends HTTP/2 PING frame with data and waits for PING ACK with
+// the same data.  It returns the round-trip time.  Unrelated frames
+// received in the meantime are ignored, but GOAWAY makes it fail.
+func (st *serverTester) ping(data [8]byte) (time.Duration, error) {
+	if err := st.sendPreface(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if err := st.fr.WritePing(false, data); err != nil {
+		return 0, err
+	}
+
+	timeout := time.After(st.http2ReadTimeout())
+	for {
+		fr, err := st.readFrameTimeout(timeout)
+		if err != nil {
+			return 0, err
+		}
+		switch f := fr.(type) {
+		case *http2.PingFrame:
+			if f.IsAck() && f.Data == data {
+				return time.Since(start), nil
+			}
+		case *http2.GoAwayFrame:
+			return 0, fmt.Errorf("GOAWAY received before PING ACK: %v", f.ErrCode)
+		case *http2.SettingsFrame:
+			if f.IsAck() {
+				break
+			}
+			if err := st.fr.WriteSettingsAck(); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// spdyPing sends SPDY PING frame and waits for the server to echo it
+// back.  It returns the round-trip time.  Unrelated frames received in
+// the meantime are ignored, but GOAWAY makes it fail.
+func (st *serverTester) spdyPing() (time.Duration, error) {
+	id := st.nextSpdyPingID
+	st.nextSpdyPingID += 2
+
+	start := time.Now()
+	if err := st.spdyFr.WriteFrame(&spdy.PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+
+	timeout := time.After(st.spdyReadTimeout())
+	for {
+		fr, err := st.readSpdyFrameTimeout(timeout)
+		if err != nil {
+			return 0, err
+		}
+		switch f := fr.(type) {
+		case *spdy.PingFrame:
+			if f.Id == id {
+				return time.Since(start), nil
+			}
+		case *spdy.GoAwayFrame:
+			return 0, fmt.Errorf("GOAWAY received before PING: %v", f.Status)
+		case *spdy.SettingsFrame:
+			st.recordSpdyServerSettings(f)
+		}
+	}
+}
+
+// spdyWriteSettings sends SPDY SETTINGS frame containing values.
+func (st *serverTester) spdyWriteSettings(values ...spdy.SettingsFlagIdValue) error {
+	return st.spdyFr.WriteFrame(&spdy.SettingsFrame{
+		FlagIdValues: values,
+	})
+}
+
+// recordSpdyServerSettings stores the values in SPDY SETTINGS f sent
+// by server to st.spdyServerSettings.
+func (st *serverTester) recordSpdyServerSettings(f *spdy.SettingsFrame) {
+	for _, v := range f.FlagIdValues {
+		st.spdyServerSettings[v.Id] = v.Value
+	}
+}
+
+// writeRaw writes b to the connection as it is.  http2.Framer writes
+// each frame to the connection at once without buffering, so it is
+// safe to mix writeRaw with the framer's writes at frame boundaries.
+func (st *serverTester) writeRaw(b []byte) error {
+	_, err := st.conn.Write(b)
+	return err
+}
+
+// writeRSTStream sends RST_STREAM frame with code to stream
+// streamID.  It does not change the stream ID bookkeeping.
+func (st *serverTester) writeRSTStream(streamID uint32, code http2.ErrCode) error {
+	return st.fr.WriteRSTStream(streamID, code)
+}
+
+// writeGoAway sends GOAWAY frame with lastStreamID, code and debug
+// data.  debug is sent verbatim, regardless of its length.
+func (st *serverTester) writeGoAway(lastStreamID uint32, code http2.ErrCode, debug []byte) error {
+	return st.fr.WriteGoAway(lastStreamID, code, debug)
+}
+
+// writePriority sends PRIORITY frame for stream streamID, which
+// depends on stream dep.  weight is the actual weight minus 1, as it
+// appears on the wire.  Dependency is sent as it is, even if it
+// depends on itself or makes a cycle.
+func (st *serverTester) writePriority(streamID uint32, dep uint32, weight uint8, exclusive bool) error {
+	return st.fr.WritePriority(streamID, http2.PriorityParam{
+		StreamDep: dep,
+		Exclusive: exclusive,
+		Weight:    weight,
+	})
+}
+
+// writeWindowUpdate sends WINDOW_UPDATE frame with increment.  If
+// streamID is 0, it increases connection-level flow control window,
+// which is shared by all streams.  Otherwise, it increases the window
+// of stream streamID only.  Server can send DATA only when both
+// windows are open.
+func (st *serverTester) writeWindowUpdate(streamID uint32, increment uint32) error {
+	if err := st.fr.WriteWindowUpdate(streamID, increment); err != nil {
+		return err
+	}
+	if streamID == 0 {
+		st.connRecvWindow += int(increment)
+	}
+	return nil
+}
+
+// autoWindowUpdate sends connection-level and stream-level
+// WINDOW_UPDATE to give back the window consumed by f, unless
+// st.manualWindowUpdate is true.  Connection-level WINDOW_UPDATE is
+// not sent if st.manualConnWindowUpdate is true, and stream-level one
+// is not sent if f ends the stream.
+func (st *serverTester) autoWindowUpdate(f *http2.DataFrame) error {
+	if st.manualWindowUpdate || f.Length == 0 {
+		return nil
+	}
+	if !st.manualConnWindowUpdate {
+		if err := st.writeWindowUpdate(0, f.Length); err != nil {
+			return err
+		}
+	}
+	if f.StreamEnded() {
+		return nil
+	}
+	return st.writeWindowUpdate(f.StreamID, f.Length)
+}
+
+type serverResponse struct {
+	status             int                  // HTTP status code
+	header             http.Header          // response header fields
+	headerFields       []hpack.HeaderField  // response header fields in the order of reception in HTTP/2
+	headerError        error                // error found in response header or trailer if serverTester.strictHeader is true
+	trailer            http.Header          // response trailer fields
+	headersEndStream   bool                 // true if END_STREAM is set in the HEADERS carrying response header in HTTP/2, so that neither DATA nor trailer follows; it is trailers-only response in gRPC
+	body               []byte               // response body
+	errCode            http2.ErrCode        // error code received in HTTP/2 RST_STREAM or GOAWAY
+	reset              bool                 // true if HTTP/2 RST_STREAM is received, which tells RST_STREAM with NO_ERROR from no RST_STREAM
+	connErr            bool                 // true if HTTP/2 connection error
+	goAwayLastStreamID uint32               // last stream ID received in HTTP/2 GOAWAY with error
+	goAwayDebugData    []byte               // debug data received in HTTP/2 GOAWAY with error
+	spdyGoAwayErrCode  spdy.GoAwayStatus    // status code received in SPDY RST_STREAM
+	spdyRstErrCode     spdy.RstStreamStatus // status code received in SPDY GOAWAY
+	connClose          bool                 // Conection: close is included in response header in HTTP/1 test
+	interimStatus      int                  // status code of interim response received for Expect: 100-continue in HTTP/1 test
+	interimResponses   []*serverResponse    // 1xx responses received before the final response in HTTP/2, in the order of reception
+	streamID           uint32               // stream ID in HTTP/2
+	reqHeader          http.Header          // request header fields of pushed stream, taken from PUSH_PROMISE in HTTP/2 or SYN_STREAM in SPDY
+	pushResponses      []*serverResponse    // pushed responses associated to this response in HTTP/2 and SPDY
+	firstByteTime      time.Time            // time when the first byte of response is received
+	lastByteTime       time.Time            // time when the last byte of response is received
+	firstDataTime      time.Time            // time when the first HTTP/2 DATA carrying response body is received
+}
+
+// recordByteTime records the current time as lastByteTime, and also
+// as firstByteTime if it is not recorded yet.  In HTTP/2 and SPDY,
+// the time is recorded per frame.
+func (res *serverResponse) recordByteTime() {
+	now := time.Now()
+	if res.firstByteTime.IsZero() {
+		res.firstByteTime = now
+	}
+	res.lastByteTime = now
+}
+
+// recordDataTime records the current time as firstDataTime if f is
+// the first DATA which carries response body.  Unlike firstByteTime,
+// it is not set by HEADERS, which server sends as soon as it receives
+// response header from backend.
+func (res *serverResponse) recordDataTime(f *http2.DataFrame) {
+	if len(f.Data()) > 0 && res.firstDataTime.IsZero() {
+		res.firstDataTime = time.Now()
+	}
+}
+
+// assertResponse reports error through st.t if res does not have
+// wantStatus, header fields in wantHeader, or wantBody.  Header field
+// names in wantHeader are case-insensitive, and header fields not in
+// wantHeader are not checked.  The body is not checked if wantBody is
+// nil.
+func (st *serverTester) assertResponse(res *serverResponse, wantStatus int, wantHeader map[string]string, wantBody []byte) {
+	if got := res.status; got != wantStatus {
+		st.t.Errorf("status: %v; want %v", got, wantStatus)
+	}
+	for k, want := range wantHeader {
+		if _, ok := res.header[http.CanonicalHeaderKey(k)]; !ok {
+			st.t.Errorf("%v: missing; want %q", k, want)
+			continue
+		}
+		if got := res.header.Get(k); got != want {
+			st.t.Errorf("%v: %q; want %q", k, got, want)
+		}
+	}
+	if wantBody != nil && !bytes.Equal(res.body, wantBody) {
+		st.t.Errorf("body: %q; want %q", res.body, wantBody)
+	}
+}
+
+// assertEarlyHints reports error through st.t unless res has
+// received 103 Early Hints responses carrying Link header field
+// values in wantLinks, in order, before the final response.
+// wantLinks[i] is the Link values of the i-th 103 response.  Other
+// interim responses, such as 100 Continue, are ignored.
+func (st *serverTester) assertEarlyHints(res *serverResponse, wantLinks [][]string) {
+	var hints []*serverResponse
+	for _, r := range res.interimResponses {
+		if r.status == 103 {
+			hints = append(hints, r)
+		}
+	}
+	if got, want := len(hints), len(wantLinks); got != want {
+		st.t.Errorf("number of 103 responses: %v; want %v", got, want)
+		return
+	}
+	for i, hint := range hints {
+		if got, want := hint.header["Link"], wantLinks[i]; !reflect.DeepEqual(got, want) {
+			st.t.Errorf("103 response #%v: link: %q; want %q", i, got, want)
+		}
+	}
+}
+
+// grpcStatus returns the value of grpc-status and grpc-message.  They
+// are taken from the trailer, or from the response header if res is
+// trailers-only, that is res.headersEndStream is true, or the
+// trailer lacks grpc-status.  ok is false if grpc-status is missing
+// or malformed.
+func (res *serverResponse) grpcStatus() (code int, message string, ok bool) {
+	h := res.trailer
+	if res.headersEndStream || h.Get("grpc-status") == "" {
+		h = res.header
+	}
+	code, err := strconv.Atoi(h.Get("grpc-status"))
+	if err != nil {
+		return 0, "", false
+	}
+	return code, h.Get("grpc-message"), true
+}
+
+// grpcFrame returns msg prefixed with the gRPC message header: 1 byte
+// compressed flag, which is always 0, and 4 bytes message length in
+// network byte order.
+func grpcFrame(msg []byte) []byte {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// parseGRPCFrames splits b into length-prefixed gRPC messages.
+func parseGRPCFrames(b []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return nil, fmt.Errorf("truncated gRPC message header: %v bytes", len(b))
+		}
+		n := binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+		if uint32(len(b)) < n {
+			return nil, fmt.Errorf("truncated gRPC message: %v bytes; want %v", len(b), n)
+		}
+		msgs = append(msgs, b[:n])
+		b = b[n:]
+	}
+	return msgs, nil
+}
+
+// headerValueOfSize returns header field value of n bytes.
+func headerValueOfSize(n int) string {
+	return strings.Repeat("a", n)
+}
+
+// manyHeaderFields returns n header fields whose names are distinct.
+// They are marked sensitive, so that HPACK encodes them without
+// indexing, and they do not evict useful entries from the dynamic
+// table.
+func manyHeaderFields(n int) []hpack.HeaderField {
+	hfs := make([]hpack.HeaderField, n)
+	for i := range hfs {
+		hfs[i] = hpack.HeaderField{
+			Name:      fmt.Sprintf("x-header-%04d", i),
+			Value:     "a",
+			Sensitive: true,
+		}
+	}
+	return hfs
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
 		vv2 := make([]string, len(vv))
 		copy(vv2, vv)
 		h2[k] = vv2
@@ -559,3 +2996,89 @@ func cloneHeader(h http.Header) http.Header {
 }
 
 func noopHandler(w http.ResponseWriter, r *http.Request) {}
+
+// readBodyHandler reads request body, so that backend server records
+// whole body, and responds with 200.
+func readBodyHandler(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+}
+
+// fixedHandler returns handler which responds with status, header
+// and body.
+func fixedHandler(status int, header http.Header, body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, vv := range header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// rawHandler returns handler which writes resp to the connection as
+// it is, and closes the connection.  It is used to send response
+// which net/http refuses to produce, such as the one whose
+// Content-Length disagrees with body.  It requires HTTP/1 backend
+// server; with HTTP/2 backend, which cannot be hijacked, it responds
+// with 500.
+func rawHandler(resp string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "rawHandler requires HTTP/1 backend", http.StatusInternalServerError)
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString(resp)
+		bufrw.Flush()
+	}
+}
+
+// gzipBytes returns b compressed in gzip format.
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// gunzipBytes returns b decompressed from gzip format.
+func gunzipBytes(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// echoRequest is the request reflected back by echoHandler in JSON.
+type echoRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Body   string `json:"body"`
+}
+
+// echoHandler responds with the method, path and body of the request
+// encoded in JSON as echoRequest.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(echoRequest{
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Body:   string(body),
+	})
+}